@@ -0,0 +1,227 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Value types compared in A/B tests
+const (
+	ValueTypeError       = "error"
+	ValueTypeUnsupported = "unsupported"
+	ValueTypeEmpty       = "empty"
+	ValueTypeInteger     = "integer"
+	ValueTypeFloat       = "float"
+	ValueTypeText        = "text"
+)
+
+// ValueType returns the type of value in the result of a check.
+func ValueType(result *Result) string {
+	switch {
+	case result.Err != nil:
+		return ValueTypeError
+
+	case result.Unsupported():
+		return ValueTypeUnsupported
+
+	case strings.TrimSpace(result.Value) == "":
+		return ValueTypeEmpty
+	}
+
+	value := strings.TrimSpace(result.Value)
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ValueTypeInteger
+	}
+	if _, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return ValueTypeInteger
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return ValueTypeFloat
+	}
+
+	return ValueTypeText
+}
+
+// ABKeyStats holds the results of a single key from both agents in an A/B
+// test.
+type ABKeyStats struct {
+	A KeyStats
+	B KeyStats
+
+	// Pairs is the number of times the key was checked on both agents.
+	Pairs int64
+
+	// TypeDiffs is the number of pairs with a different type of value.
+	TypeDiffs int64
+
+	// ValueDiffs is the number of pairs with the same type but a different
+	// value.
+	ValueDiffs int64
+
+	// The most recent pair of differing values
+	LastA string
+	LastB string
+}
+
+// An ABTest compares the results of the same checks made against two agents.
+type ABTest struct {
+	mu    sync.Mutex
+	HostA string
+	HostB string
+	keys  map[string]*ABKeyStats
+}
+
+// NewABTest returns an ABTest comparing two agent hosts.
+func NewABTest(hostA, hostB string) *ABTest {
+	return &ABTest{
+		HostA: hostA,
+		HostB: hostB,
+		keys:  make(map[string]*ABKeyStats, 0),
+	}
+}
+
+// Record adds the results of checking a key on both agents.
+func (c *ABTest) Record(key string, a, b *Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats, ok := c.keys[key]
+	if !ok {
+		stats = &ABKeyStats{}
+		c.keys[key] = stats
+	}
+
+	recordKeyStats(&stats.A, a)
+	recordKeyStats(&stats.B, b)
+	stats.Pairs++
+
+	typeA, typeB := ValueType(a), ValueType(b)
+	if typeA != typeB {
+		stats.TypeDiffs++
+		stats.LastA, stats.LastB = describeValue(a), describeValue(b)
+	} else if (typeA != ValueTypeError && typeA != ValueTypeUnsupported) && a.Value != b.Value {
+		stats.ValueDiffs++
+		stats.LastA, stats.LastB = describeValue(a), describeValue(b)
+	}
+}
+
+// Get returns a copy of the stats of a key.
+func (c *ABTest) Get(key string) ABKeyStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stats, ok := c.keys[key]; ok {
+		return *stats
+	}
+
+	return ABKeyStats{}
+}
+
+// recordKeyStats adds the result of a check to the stats of a key.
+func recordKeyStats(stats *KeyStats, result *Result) {
+	stats.Latency.Observe(result.Latency)
+	if failure := result.Failure(); failure != "" {
+		stats.LastFailure = failure
+	}
+
+	switch {
+	case result.Err != nil:
+		stats.Error++
+	case result.Unsupported():
+		stats.NotSupported++
+	default:
+		stats.Success++
+	}
+}
+
+// describeValue returns a short, printable description of the value of a
+// result.
+func describeValue(result *Result) string {
+	s := result.Failure()
+	if s == "" {
+		s = result.Value
+	}
+
+	if len(s) > 40 {
+		s = s[:37] + "..."
+	}
+
+	return strconv.Quote(s)
+}
+
+// Print prints the latency and results of each key on both agents, followed
+// by any keys which returned different values.
+func (c *ABTest) Print(keyNames []string, longestKeyName int) {
+	fmt.Printf("\n=== A/B comparison ===\n\n")
+	fmt.Printf("A: %s\nB: %s\n\n", c.HostA, c.HostB)
+	fmt.Printf("%-*s  \tA p95\t\tB p95\t\tchange\t\tA failed\tB failed\n", longestKeyName, "key")
+	for _, name := range keyNames {
+		stats := c.Get(name)
+		if stats.Pairs == 0 {
+			continue
+		}
+
+		p95A, p95B := stats.A.Latency.Percentile(95), stats.B.Latency.Percentile(95)
+		failedA, failedB := failureRate(stats.A), failureRate(stats.B)
+		color := "default"
+		if failedA != failedB {
+			color = "yellow"
+		}
+
+		row := fmt.Sprintf("%-*s :\t%-10s\t%-10s\t%+.1f%%\t\t%.2f%%\t\t%.2f%%", longestKeyName, name, formatLatency(p95A), formatLatency(p95B), change(float64(p95A), float64(p95B)), failedA, failedB)
+		fmt.Println(colorize(color, row))
+	}
+
+	diffs := 0
+	for _, name := range keyNames {
+		stats := c.Get(name)
+		if stats.TypeDiffs+stats.ValueDiffs == 0 {
+			continue
+		}
+
+		if diffs == 0 {
+			fmt.Printf("\n=== Keys with different values ===\n\n")
+		}
+		diffs++
+
+		color := "yellow"
+		if stats.TypeDiffs > 0 {
+			color = "red"
+		}
+		fmt.Printf("%s: %d type and %d value differences in %d checks (last A: %s, B: %s)\n", colorize(color, name), stats.TypeDiffs, stats.ValueDiffs, stats.Pairs, stats.LastA, stats.LastB)
+	}
+}
+
+// TypeDiffKeys returns the number of keys which returned a different type of
+// value from each agent at least once.
+func (c *ABTest) TypeDiffKeys() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, stats := range c.keys {
+		if stats.TypeDiffs > 0 {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,265 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AgentConfig is the subset of a zabbix_agentd.conf configuration file which
+// is of interest when benchmarking an agent.
+type AgentConfig struct {
+	Path                 string
+	Timeout              time.Duration
+	UnsafeUserParameters bool
+	UserParameters       []*UserParameter
+}
+
+// A UserParameter is a custom item defined in a Zabbix agent configuration
+// file.
+type UserParameter struct {
+	Key      string
+	Flexible bool
+	Command  string
+	Origin   KeyOrigin
+}
+
+// AgentDefaultTimeout is the default value of the Timeout parameter in
+// zabbix_agentd.conf.
+const AgentDefaultTimeout = 3 * time.Second
+
+// UnsafeUserParameterChars are the characters which the agent does not allow
+// in the parameters of flexible UserParameters unless UnsafeUserParameters=1.
+const UnsafeUserParameterChars = "\\'\"`*?[]{}~$!&;()<>|#@\n"
+
+// LoadAgentConfig parses a Zabbix agent configuration file and any files
+// referenced by its Include parameters.
+func LoadAgentConfig(path string) (*AgentConfig, error) {
+	config := &AgentConfig{
+		Path:           path,
+		Timeout:        AgentDefaultTimeout,
+		UserParameters: make([]*UserParameter, 0),
+	}
+
+	if err := config.load(path, nil); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// load parses a single configuration file into c. parents lists the absolute
+// paths of all files which included this file and is used to detect include
+// cycles.
+func (c *AgentConfig) load(path string, parents []string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	for _, parent := range parents {
+		if parent == absPath {
+			return NewError(nil, "Agent config include cycle detected: %s -> %s", strings.Join(parents, " -> "), absPath)
+		}
+	}
+	parents = append(parents, absPath)
+
+	dprintf("Loading agent config file: %s\n", path)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lineNo := 0
+	buf := bufio.NewScanner(file)
+	for buf.Scan() {
+		line := strings.TrimSpace(buf.Text())
+		lineNo++
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return NewError(nil, "Invalid agent config parameter at %s:%d", path, lineNo)
+		}
+		name, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch name {
+		case "Include":
+			if !filepath.IsAbs(val) {
+				val = filepath.Join(filepath.Dir(path), val)
+			}
+
+			files, err := ExpandPath(val)
+			if err != nil {
+				return NewError(err, "Failed to include agent config at %s:%d", path, lineNo)
+			}
+
+			for _, f := range files {
+				if err := c.load(f, parents); err != nil {
+					return NewError(err, "Failed to include agent config at %s:%d", path, lineNo)
+				}
+			}
+
+		case "Timeout":
+			seconds, err := strconv.Atoi(val)
+			if err != nil {
+				return NewError(err, "Invalid Timeout at %s:%d", path, lineNo)
+			}
+			c.Timeout = time.Duration(seconds) * time.Second
+
+		case "UnsafeUserParameters":
+			switch val {
+			case "0":
+				c.UnsafeUserParameters = false
+			case "1":
+				c.UnsafeUserParameters = true
+			default:
+				return NewError(nil, "Invalid UnsafeUserParameters at %s:%d", path, lineNo)
+			}
+
+		case "UserParameter":
+			param := strings.SplitN(val, ",", 2)
+			if len(param) != 2 {
+				return NewError(nil, "Invalid UserParameter at %s:%d", path, lineNo)
+			}
+
+			userParam := &UserParameter{
+				Key:     strings.TrimSpace(param[0]),
+				Command: param[1],
+				Origin:  KeyOrigin{File: path, Line: lineNo},
+			}
+
+			if strings.HasSuffix(userParam.Key, "[*]") {
+				userParam.Key = strings.TrimSuffix(userParam.Key, "[*]")
+				userParam.Flexible = true
+			}
+
+			dprintf("Found UserParameter: %s\n", userParam.Key)
+			c.UserParameters = append(c.UserParameters, userParam)
+		}
+	}
+
+	if err := buf.Err(); err != nil {
+		return NewError(err, "Failed to read agent config: %s", path)
+	}
+
+	return nil
+}
+
+// ParamCount returns the highest positional parameter ($1 to $9) referenced by
+// the command of a flexible UserParameter.
+func (c *UserParameter) ParamCount() int {
+	if !c.Flexible {
+		return 0
+	}
+
+	count := 0
+	for i := 0; i < len(c.Command)-1; i++ {
+		if c.Command[i] == '$' && c.Command[i+1] >= '1' && c.Command[i+1] <= '9' {
+			if n := int(c.Command[i+1] - '0'); n > count {
+				count = n
+			}
+		}
+	}
+
+	return count
+}
+
+// PlaceholderKey returns an item key for the UserParameter. Each parameter of
+// a flexible UserParameter is set to an environment variable placeholder
+// named after the key and parameter position, such as {%PGSQL_PING_1}.
+func (c *UserParameter) PlaceholderKey() string {
+	if !c.Flexible {
+		return c.Key
+	}
+
+	prefix := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(c.Key))
+
+	params := make([]string, c.ParamCount())
+	for i := range params {
+		params[i] = "{%" + prefix + "_" + strconv.Itoa(i+1) + "}"
+	}
+
+	return c.Key + "[" + strings.Join(params, ",") + "]"
+}
+
+// Expand returns the command of the UserParameter with $1 to $9 replaced by
+// the given key parameters, as done by the agent. Missing parameters are
+// replaced with an empty string. Commands of UserParameters which are not
+// flexible are returned unchanged.
+func (c *UserParameter) Expand(params []string) string {
+	if !c.Flexible {
+		return c.Command
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(c.Command); i++ {
+		if c.Command[i] == '$' && i+1 < len(c.Command) && c.Command[i+1] >= '1' && c.Command[i+1] <= '9' {
+			if n := int(c.Command[i+1] - '1'); n < len(params) {
+				b.WriteString(params[n])
+			}
+			i++
+			continue
+		}
+		b.WriteByte(c.Command[i])
+	}
+
+	return b.String()
+}
+
+// Command returns the command which the agent runs for an item key, or false
+// if the key is not a UserParameter. As done by the agent, an error is
+// returned for keys with parameters which contain any of the
+// UnsafeUserParameterChars, unless UnsafeUserParameters is set.
+func (c *AgentConfig) Command(key string) (string, bool, error) {
+	name, params, err := ParseKeyParams(key)
+	if err != nil {
+		return "", false, nil
+	}
+
+	for _, param := range c.UserParameters {
+		if param.Key != name || (!param.Flexible && params != nil) {
+			continue
+		}
+
+		if !c.UnsafeUserParameters {
+			for _, p := range params {
+				if strings.ContainsAny(p, UnsafeUserParameterChars) {
+					return "", true, NewError(nil, "Special characters \"%s\" are not allowed in the parameters.", strings.Replace(UnsafeUserParameterChars, "\n", "\\n", -1))
+				}
+			}
+		}
+
+		return param.Expand(params), true, nil
+	}
+
+	return "", false, nil
+}
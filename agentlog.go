@@ -0,0 +1,328 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxKeyLogLines is the number of log lines kept for each key, keeping
+	// the most recent. Routine lines are dropped before any other lines.
+	maxKeyLogLines = 10
+
+	// agentLogPoll is the interval at which the agent log is read.
+	agentLogPoll = 250 * time.Millisecond
+)
+
+var (
+	// agentLogPattern matches a line of a Zabbix agent log, given as
+	// '<pid>:<yyyymmdd>:<hhmmss.mmm> <message>'.
+	agentLogPattern = regexp.MustCompile(`^\s*(\d+):(\d{8}:\d{6}\.\d{3}) (.*)$`)
+
+	// agentLogRequest matches the message logged by an agent at DebugLevel=4
+	// when it receives a request for a key.
+	agentLogRequest = regexp.MustCompile(`^Requested \[(.*)\]$`)
+
+	// agentLogRoutine matches the messages logged by an agent at DebugLevel=4
+	// for every request which are not of interest unless they report a
+	// failure.
+	agentLogRoutine = regexp.MustCompile(`^(Requested|Sending back) \[.*\]$`)
+)
+
+// An AgentLogLine is a single line of a Zabbix agent log.
+type AgentLogLine struct {
+	PID     int
+	Time    time.Time
+	Message string
+	seq     int
+}
+
+// Routine returns true if the line is a request or response logged for every
+// check, and does not report that the key was unsupported.
+func (c *AgentLogLine) Routine() bool {
+	return agentLogRoutine.MatchString(c.Message) && !strings.Contains(c.Message, ErrorMessage)
+}
+
+// isKeyChar returns true if b may appear in the name of an item key.
+func isKeyChar(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_' || b == '-' || b == '.'
+}
+
+// containsKey returns true if a log message names the given key, and not only
+// a longer key which starts or ends with it, such as the same key with
+// parameters.
+func containsKey(message, key string) bool {
+	for i := 0; i+len(key) <= len(message); {
+		j := strings.Index(message[i:], key)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(key)
+
+		if (start == 0 || !isKeyChar(message[start-1])) && (end == len(message) || (!isKeyChar(message[end]) && message[end] != '[')) {
+			return true
+		}
+		i = start + 1
+	}
+
+	return false
+}
+
+// String returns the line as it appeared in the log.
+func (c *AgentLogLine) String() string {
+	return fmt.Sprintf("%d:%s %s", c.PID, c.Time.Format("20060102:150405.000"), c.Message)
+}
+
+// ParseAgentLogLine parses a line of a Zabbix agent log. Times are in the
+// local time zone.
+func ParseAgentLogLine(s string) (*AgentLogLine, error) {
+	m := agentLogPattern.FindStringSubmatch(s)
+	if m == nil {
+		return nil, NewError(nil, "Invalid agent log line: %s", s)
+	}
+
+	pid, err := strconv.Atoi(m[1])
+	if err != nil {
+		return nil, NewError(err, "Invalid PID in agent log line: %s", s)
+	}
+
+	t, err := time.ParseInLocation("20060102:150405.000", m[2], time.Local)
+	if err != nil {
+		return nil, NewError(err, "Invalid time in agent log line: %s", s)
+	}
+
+	return &AgentLogLine{PID: pid, Time: t, Message: m[3]}, nil
+}
+
+// An AgentLog follows a Zabbix agent log file during a run, from its end when
+// the run started, and attributes each line to the key being processed. At
+// DebugLevel=4, each agent process logs the key it was requested before any
+// errors while processing it, so lines are attributed to the last key
+// requested by the same process, or to any key named in the line. Routine
+// lines are kept apart so that the requests of a busy key do not push out the
+// lines of its failures.
+type AgentLog struct {
+	mu         sync.Mutex
+	Path       string
+	file       *os.File
+	offset     int64
+	partial    string
+	lines      int
+	current    map[int]string
+	keyLines   map[string][]*AgentLogLine
+	keyRoutine map[string][]*AgentLogLine
+	keys       map[string]bool
+	quit       chan bool
+	done       chan bool
+}
+
+// NewAgentLog returns an AgentLog which attributes lines to the given keys.
+func NewAgentLog(path string, keys ItemKeys) *AgentLog {
+	c := &AgentLog{
+		Path:       path,
+		current:    make(map[int]string),
+		keyLines:   make(map[string][]*AgentLogLine),
+		keyRoutine: make(map[string][]*AgentLogLine),
+		keys:       make(map[string]bool, len(keys)),
+		quit:       make(chan bool),
+		done:       make(chan bool),
+	}
+	for _, key := range keys {
+		c.keys[key.Key] = true
+	}
+
+	return c
+}
+
+// Start opens the log at its end and follows it until Stop is called.
+func (c *AgentLog) Start() error {
+	f, err := os.Open(c.Path)
+	if err != nil {
+		return NewError(err, "Failed to open agent log")
+	}
+
+	if c.offset, err = f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return NewError(err, "Failed to seek agent log")
+	}
+	c.file = f
+
+	go func() {
+		ticker := time.NewTicker(agentLogPoll)
+		defer ticker.Stop()
+		defer close(c.done)
+
+		for {
+			select {
+			case <-ticker.C:
+				c.read()
+
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop reads any remaining lines and closes the log.
+func (c *AgentLog) Stop() {
+	close(c.quit)
+	<-c.done
+	c.read()
+	c.file.Close()
+}
+
+// read reads new lines from the log. If the log was truncated or rotated, it
+// is reopened from the start.
+func (c *AgentLog) read() {
+	if info, err := os.Stat(c.Path); err == nil {
+		current, _ := c.file.Stat()
+		if info.Size() < c.offset || (current != nil && !os.SameFile(info, current)) {
+			dprintf("Agent log was rotated: %s\n", c.Path)
+			if f, err := os.Open(c.Path); err == nil {
+				c.file.Close()
+				c.file, c.offset, c.partial = f, 0, ""
+			}
+		}
+	}
+
+	b := make([]byte, 64*1024)
+	for {
+		n, err := c.file.ReadAt(b, c.offset)
+		c.offset += int64(n)
+		c.partial += string(b[:n])
+		if err != nil || n == 0 {
+			break
+		}
+	}
+
+	i := strings.LastIndex(c.partial, "\n")
+	if i < 0 {
+		return
+	}
+	for _, s := range strings.Split(c.partial[:i], "\n") {
+		c.Add(strings.TrimRight(s, "\r"))
+	}
+	c.partial = c.partial[i+1:]
+}
+
+// Add parses a line of the log and attributes it to a key. Lines which are
+// not in the agent log format are ignored.
+func (c *AgentLog) Add(s string) {
+	line, err := ParseAgentLogLine(s)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lines++
+	line.seq = c.lines
+	if m := agentLogRequest.FindStringSubmatch(line.Message); m != nil {
+		c.current[line.PID] = m[1]
+	}
+
+	keys := make(map[string]bool)
+	if key := c.current[line.PID]; c.keys[key] {
+		keys[key] = true
+	}
+	for key := range c.keys {
+		if !keys[key] && containsKey(line.Message, key) {
+			keys[key] = true
+		}
+	}
+
+	keyLines := c.keyLines
+	if line.Routine() {
+		keyLines = c.keyRoutine
+	}
+	for key := range keys {
+		lines := append(keyLines[key], line)
+		if len(lines) > maxKeyLogLines {
+			lines = lines[len(lines)-maxKeyLogLines:]
+		}
+		keyLines[key] = lines
+	}
+}
+
+// Lines returns up to maxKeyLogLines of the lines attributed to a key, in the
+// order they were logged. The most recent lines which are not routine are
+// kept first, followed by the most recent routine lines.
+func (c *AgentLog) Lines(key string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	kept := append([]*AgentLogLine{}, c.keyLines[key]...)
+	routine := c.keyRoutine[key]
+	if n := maxKeyLogLines - len(kept); n < len(routine) {
+		routine = routine[len(routine)-n:]
+	}
+	kept = append(kept, routine...)
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].seq < kept[j].seq
+	})
+
+	lines := make([]string, 0, len(kept))
+	for _, line := range kept {
+		lines = append(lines, line.String())
+	}
+
+	return lines
+}
+
+// Count returns the number of log lines read.
+func (c *AgentLog) Count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lines
+}
+
+// PrintAgentLog prints the log lines attached to each key and returns the
+// number of keys with log lines.
+func PrintAgentLog(keys []*KeyReport) int {
+	n := 0
+	for _, key := range keys {
+		if len(key.Log) == 0 {
+			continue
+		}
+
+		if n == 0 {
+			fmt.Printf("\n=== Agent log ===\n")
+		}
+		n++
+
+		fmt.Printf("\n%s:\n", key.Key)
+		for _, line := range key.Log {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,169 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Agent availability states
+const (
+	AgentAvailable = iota
+	AgentUnreachable
+	AgentUnavailable
+)
+
+// An Outage is a period of time in which the agent was unreachable.
+type Outage struct {
+	Start  time.Time
+	End    time.Time
+	Errors int64
+	Probes int64
+}
+
+// Duration returns the length of an outage, or the time since the outage
+// started if it has not yet ended.
+func (c *Outage) Duration() time.Duration {
+	if c.End.IsZero() {
+		return time.Now().Sub(c.Start)
+	}
+
+	return c.End.Sub(c.Start)
+}
+
+// Availability tracks whether the agent is reachable in the same way as the
+// Zabbix server. After ErrorLimit consecutive network errors the agent is
+// considered unreachable and is only probed by a single request every
+// UnreachableDelay. If the agent is still unreachable after UnreachablePeriod,
+// it is considered unavailable and probed every UnavailableDelay until it
+// responds again.
+//
+// Availability is safe for use by multiple goroutines.
+type Availability struct {
+	ErrorLimit        int
+	UnreachablePeriod time.Duration
+	UnreachableDelay  time.Duration
+	UnavailableDelay  time.Duration
+
+	mu         sync.Mutex
+	state      int
+	errors     int
+	firstError time.Time
+	nextProbe  time.Time
+	probing    bool
+	outages    []*Outage
+}
+
+// Acquire returns true if a request may be sent to the agent. If the agent is
+// unreachable, only one request is allowed each time a probe is due and probe
+// is returned as true. The result of every allowed request must be passed to
+// Report.
+func (c *Availability) Acquire() (ok bool, probe bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == AgentAvailable {
+		return true, false
+	}
+
+	if !c.probing && !time.Now().Before(c.nextProbe) {
+		c.probing = true
+		c.outages[len(c.outages)-1].Probes++
+		return true, true
+	}
+
+	return false, false
+}
+
+// Report updates the availability of the agent with the result of a request.
+func (c *Availability) Report(err error, probe bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if probe {
+		c.probing = false
+	}
+
+	if err == nil {
+		if c.state != AgentAvailable {
+			dprintf("Agent is available again\n")
+			c.outages[len(c.outages)-1].End = now
+			c.state = AgentAvailable
+		}
+		c.errors = 0
+		return
+	}
+
+	c.errors++
+	switch c.state {
+	case AgentAvailable:
+		if c.errors == 1 {
+			c.firstError = now
+		}
+
+		if c.errors >= c.ErrorLimit {
+			dprintf("Agent is unreachable after %d errors\n", c.errors)
+			c.state = AgentUnreachable
+			c.nextProbe = now.Add(c.UnreachableDelay)
+			c.outages = append(c.outages, &Outage{
+				Start:  c.firstError,
+				Errors: int64(c.errors),
+			})
+		}
+
+	default:
+		outage := c.outages[len(c.outages)-1]
+		outage.Errors++
+		if !probe {
+			return
+		}
+
+		if c.state == AgentUnreachable && now.Sub(outage.Start) >= c.UnreachablePeriod {
+			dprintf("Agent is unavailable\n")
+			c.state = AgentUnavailable
+		}
+
+		if c.state == AgentUnavailable {
+			c.nextProbe = now.Add(c.UnavailableDelay)
+		} else {
+			c.nextProbe = now.Add(c.UnreachableDelay)
+		}
+	}
+}
+
+// State returns the current availability state of the agent.
+func (c *Availability) State() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+// Outages returns a copy of all outages recorded so far.
+func (c *Availability) Outages() []Outage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	outages := make([]Outage, len(c.outages))
+	for i, outage := range c.outages {
+		outages[i] = *outage
+	}
+
+	return outages
+}
@@ -0,0 +1,239 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"github.com/mitchellh/colorstring"
+	"os"
+	"strings"
+	"time"
+)
+
+// ProbeKey is the key used to check whether the agent is up.
+const ProbeKey = "agent.ping"
+
+// MinimizeKeys returns a minimal subset of keys for which fails returns true,
+// using delta debugging. The full list of keys must fail. The subset is
+// 1-minimal; removing any single key from it no longer fails.
+func MinimizeKeys(keys ItemKeys, fails func(ItemKeys) (bool, error)) (ItemKeys, error) {
+	n := 2
+	for len(keys) >= 2 {
+		chunks := splitKeys(keys, n)
+		reduced := false
+
+		// try each chunk on its own
+		for _, chunk := range chunks {
+			ok, err := fails(chunk)
+			if err != nil {
+				return keys, err
+			}
+			if ok {
+				keys, n, reduced = chunk, 2, true
+				break
+			}
+		}
+
+		// try each complement of a chunk, which are the chunks themselves if
+		// there are only two
+		if !reduced && n > 2 {
+			for i := range chunks {
+				complement := ItemKeys{}
+				for j, chunk := range chunks {
+					if i != j {
+						complement = append(complement, chunk...)
+					}
+				}
+
+				ok, err := fails(complement)
+				if err != nil {
+					return keys, err
+				}
+				if ok {
+					keys, n, reduced = complement, n-1, true
+					break
+				}
+			}
+		}
+
+		if !reduced {
+			if n >= len(keys) {
+				break
+			}
+			n *= 2
+			if n > len(keys) {
+				n = len(keys)
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// splitKeys splits a list of keys into n chunks of near equal size.
+func splitKeys(keys ItemKeys, n int) []ItemKeys {
+	chunks := make([]ItemKeys, 0, n)
+	start := 0
+	for i := 0; i < n; i++ {
+		end := start + (len(keys)-start)/(n-i)
+		chunks = append(chunks, keys[start:end])
+		start = end
+	}
+
+	return chunks
+}
+
+// A Bisector checks subsets of keys to find those which crash or hang the
+// agent, restoring the agent after each failed trial.
+type Bisector struct {
+	Host           string
+	Threads        int
+	RestartCommand string
+	RestartWait    time.Duration
+	ProcMonitor    *ProcessMonitor
+	Trials         int
+	Restarts       int
+}
+
+// AgentUp returns true if the agent responds to a probe.
+func (c *Bisector) AgentUp() bool {
+	_, err := Get(c.Host, ProbeKey, timeout)
+	return err == nil
+}
+
+// Fails checks the given keys and returns true if the agent went down. The
+// agent is down if it does not respond afterwards or, if its process is
+// monitored, it was restarted. The agent is restored before returning.
+func (c *Bisector) Fails(keys ItemKeys) (bool, error) {
+	c.Trials++
+	hooks.RunStage(fmt.Sprintf("trial %d", c.Trials))
+	fmt.Printf("Trial %d: checking %d keys... ", c.Trials, len(keys))
+
+	pid := 0
+	if c.ProcMonitor != nil {
+		if sample, err := c.ProcMonitor.Sample(); err == nil {
+			pid = sample.PID
+		}
+	}
+
+	stats := CheckKeys(keys, c.Threads)
+
+	down := !c.AgentUp()
+	if !down && pid > 0 {
+		if sample, err := c.ProcMonitor.Sample(); err != nil || sample.PID != pid {
+			down = true
+		}
+	}
+
+	if !down {
+		fmt.Printf("ok (%d errors)\n", stats.ErrorCount)
+		return false, nil
+	}
+
+	colorstring.Printf("[red]agent went down[default] (%d errors)\n", stats.ErrorCount)
+	return true, c.Restore()
+}
+
+// Restore runs the restart command, if any, and waits for the agent to
+// respond.
+func (c *Bisector) Restore() error {
+	c.Restarts++
+	if c.RestartCommand != "" {
+		if result := RunHook(HookRestart, c.RestartCommand, hooks.Timeout); result.Failed() {
+			return NewError(nil, "Restart command failed with %s: %s", result.Describe(), strings.TrimSpace(result.Output))
+		}
+	}
+
+	deadline := time.Now().Add(c.RestartWait)
+	for !c.AgentUp() {
+		if stop || time.Now().After(deadline) {
+			return NewError(nil, "Agent did not come back within %s", c.RestartWait)
+		}
+		time.Sleep(time.Second)
+	}
+
+	return nil
+}
+
+// BisectCommand checks the full list of keys and, if the agent goes down,
+// searches for the smallest set of keys which still takes it down, then
+// prints the set and exits.
+func BisectCommand(keys ItemKeys) {
+	if iterationLimit <= 0 {
+		iterationLimit = 1
+	}
+
+	bisector := &Bisector{
+		Host:           host,
+		Threads:        threadCount,
+		RestartCommand: restartCmd,
+		RestartWait:    time.Duration(restartWait) * time.Second,
+	}
+	if agentPID > 0 || agentPIDFile != "" {
+		bisector.ProcMonitor = NewProcessMonitor(agentPID, agentPIDFile, 0)
+	}
+
+	if !bisector.AgentUp() {
+		fmt.Fprintf(os.Stderr, "Agent is not responding to %s\n", ProbeKey)
+		hooks.Exit(1)
+	}
+
+	fmt.Printf("Bisecting %d keys for %d iterations with %d threads (press Ctrl-C to cancel)...\n", len(keys), iterationLimit, threadCount)
+	HandleSignals()
+
+	start := time.Now()
+	fails, err := bisector.Fails(keys)
+	PanicOn(err, "Failed to restore agent")
+	if !fails && stop {
+		colorstring.Printf("\n[yellow]Bisect stopped[default] before all %d keys were checked\n", len(keys))
+		hooks.RunAfter()
+		hooks.Print()
+		os.Exit(1)
+	}
+	if !fails {
+		colorstring.Printf("\n[green]Agent stayed up[default] while checking all %d keys\n", len(keys))
+		hooks.RunAfter()
+		hooks.Print()
+		os.Exit(0)
+	}
+
+	culprits, err := MinimizeKeys(keys, func(keys ItemKeys) (bool, error) {
+		if stop {
+			return false, NewError(nil, "Bisect cancelled")
+		}
+		return bisector.Fails(keys)
+	})
+
+	fmt.Printf("\n=== Bisect ===\n\n")
+	if err != nil {
+		PrintError(err)
+		fmt.Printf("Smallest set of keys found so far:\n")
+	} else {
+		fmt.Printf("Smallest set of keys which takes the agent down:\n")
+	}
+	for _, key := range culprits {
+		fmt.Printf("%s%s%s\t(%s)\n", colorstring.Color("[red]"), key.Key, colorstring.Color("[default]"), key.OriginString())
+	}
+
+	hooks.RunAfter()
+	hooks.Print()
+
+	fmt.Printf("\nTotal trials:\t\t\t%d\n", bisector.Trials)
+	fmt.Printf("Total agent restarts:\t\t%d\n", bisector.Restarts)
+	fmt.Printf("Total bisect time:\t\t%s\n", time.Now().Sub(start)/time.Second*time.Second)
+	os.Exit(1)
+}
@@ -0,0 +1,291 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mitchellh/colorstring"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Thresholds are the limits beyond which a change from a baseline run is a
+// regression.
+type Thresholds struct {
+	// LatencyIncrease is the maximum increase in p95 latency in percent.
+	LatencyIncrease float64
+
+	// MinLatencyIncrease is the smallest increase in p95 latency which may be
+	// a regression, so that noise in very fast keys is ignored.
+	MinLatencyIncrease time.Duration
+
+	// NVPSDecrease is the maximum decrease in values per second in percent.
+	NVPSDecrease float64
+
+	// FailureIncrease is the maximum increase in the percentage of failed
+	// checks.
+	FailureIncrease float64
+}
+
+var thresholds Thresholds
+var minLatencyMsArg int
+
+// addThresholdFlags adds flags for the regression thresholds to a flag set.
+func addThresholdFlags(flags *flag.FlagSet) {
+	flags.Float64Var(&thresholds.LatencyIncrease, "max-latency-increase", 20, "percent increase in p95 latency from the baseline which is a regression")
+	flags.IntVar(&minLatencyMsArg, "min-latency-increase", 1, "ignore increases in p95 latency smaller than this many milliseconds")
+	flags.Float64Var(&thresholds.NVPSDecrease, "max-nvps-decrease", 10, "percent decrease in values per second from the baseline which is a regression")
+	flags.Float64Var(&thresholds.FailureIncrease, "max-failure-increase", 1, "increase in the percentage of failed checks from the baseline which is a regression")
+}
+
+// A KeyComparison holds the change in results of a single key between two
+// runs.
+type KeyComparison struct {
+	Key         string
+	Base        KeyStats
+	Current     KeyStats
+	BaseNVPS    float64
+	CurrentNVPS float64
+	Regressions []string
+}
+
+// A Comparison holds the change in results between a baseline and a current
+// run.
+type Comparison struct {
+	Base        *RunReport
+	Current     *RunReport
+	Keys        []*KeyComparison
+	Added       []string
+	Removed     []string
+	Regressions []string
+}
+
+// LoadRunReport loads a report saved with '-report json'.
+func LoadRunReport(path string) (*RunReport, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, NewError(err, "Failed to read saved results")
+	}
+
+	report := &RunReport{}
+	if err := json.Unmarshal(b, report); err != nil {
+		return nil, NewError(err, "Failed to parse saved results in %s", path)
+	}
+
+	if report.Totals == nil || report.Duration <= 0 {
+		return nil, NewError(nil, "No results found in %s", path)
+	}
+
+	return report, nil
+}
+
+// Compare returns the change in results from a baseline to a current run,
+// with any changes beyond the given thresholds listed as regressions.
+func Compare(base, current *RunReport, t Thresholds) *Comparison {
+	c := &Comparison{
+		Base:        base,
+		Current:     current,
+		Keys:        make([]*KeyComparison, 0),
+		Added:       make([]string, 0),
+		Removed:     make([]string, 0),
+		Regressions: make([]string, 0),
+	}
+
+	baseKeys := make(map[string]*KeyReport, len(base.Keys))
+	for _, key := range base.Keys {
+		baseKeys[key.Key] = key
+	}
+
+	for _, key := range current.Keys {
+		baseKey, ok := baseKeys[key.Key]
+		if !ok {
+			c.Added = append(c.Added, key.Key)
+			continue
+		}
+		delete(baseKeys, key.Key)
+
+		k := &KeyComparison{
+			Key:         key.Key,
+			Base:        baseKey.Stats,
+			Current:     key.Stats,
+			BaseNVPS:    float64(baseKey.Stats.Polls()) / base.Duration.Seconds(),
+			CurrentNVPS: float64(key.Stats.Polls()) / current.Duration.Seconds(),
+		}
+		k.Regressions = t.check(k.Base.Latency, k.Current.Latency, k.BaseNVPS, k.CurrentNVPS, failureRate(k.Base), failureRate(k.Current))
+		c.Keys = append(c.Keys, k)
+	}
+
+	for _, key := range base.Keys {
+		if _, ok := baseKeys[key.Key]; ok {
+			c.Removed = append(c.Removed, key.Key)
+		}
+	}
+
+	c.Regressions = t.check(base.Totals.Latency, current.Totals.Latency, base.NVPS(), current.NVPS(), totalFailureRate(base.Totals), totalFailureRate(current.Totals))
+
+	return c
+}
+
+// check returns a description of each change in results which exceeds the
+// thresholds.
+func (t Thresholds) check(baseLatency, latency LatencyHistogram, baseNVPS, nvps, baseFailures, failures float64) []string {
+	regressions := make([]string, 0)
+
+	baseP95, p95 := baseLatency.Percentile(95), latency.Percentile(95)
+	if p95-baseP95 >= t.MinLatencyIncrease && change(float64(baseP95), float64(p95)) > t.LatencyIncrease {
+		regressions = append(regressions, fmt.Sprintf("p95 latency increased from %s to %s", formatLatency(baseP95), formatLatency(p95)))
+	}
+
+	if -change(baseNVPS, nvps) > t.NVPSDecrease {
+		regressions = append(regressions, fmt.Sprintf("NVPS decreased from %.2f to %.2f", baseNVPS, nvps))
+	}
+
+	if failures-baseFailures > t.FailureIncrease {
+		regressions = append(regressions, fmt.Sprintf("failure rate increased from %.2f%% to %.2f%%", baseFailures, failures))
+	}
+
+	return regressions
+}
+
+// Regressed returns true if any change exceeded the thresholds.
+func (c *Comparison) Regressed() bool {
+	if len(c.Regressions) > 0 {
+		return true
+	}
+
+	for _, key := range c.Keys {
+		if len(key.Regressions) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Print prints the change in results of every key and the totals, followed
+// by any regressions.
+func (c *Comparison) Print() {
+	longestKeyName := len("Totals")
+	for _, key := range c.Keys {
+		if len(key.Key) > longestKeyName {
+			longestKeyName = len(key.Key)
+		}
+	}
+
+	fmt.Printf("%-*s  \tp50\t\tp95\t\tp99\t\tNVPS\t\tfailed\n", longestKeyName, "key")
+	for _, key := range c.Keys {
+		printComparisonRow(longestKeyName, key.Key, key.Base.Latency, key.Current.Latency, key.BaseNVPS, key.CurrentNVPS, failureRate(key.Base), failureRate(key.Current), len(key.Regressions) > 0)
+	}
+	fmt.Println()
+	printComparisonRow(longestKeyName, "Totals", c.Base.Totals.Latency, c.Current.Totals.Latency, c.Base.NVPS(), c.Current.NVPS(), totalFailureRate(c.Base.Totals), totalFailureRate(c.Current.Totals), len(c.Regressions) > 0)
+
+	if len(c.Added) > 0 {
+		fmt.Printf("\nKeys not in baseline:\t%s\n", strings.Join(c.Added, ", "))
+	}
+	if len(c.Removed) > 0 {
+		fmt.Printf("\nKeys only in baseline:\t%s\n", strings.Join(c.Removed, ", "))
+	}
+
+	if !c.Regressed() {
+		colorstring.Printf("\n[green]No regressions[default] from baseline of %s\n", c.Base.Start.Format("2006-01-02 15:04:05"))
+		return
+	}
+
+	colorstring.Printf("\n[red]=== Regressions ===[default]\n\n")
+	for _, regression := range c.Regressions {
+		fmt.Printf("Totals: %s\n", regression)
+	}
+	for _, key := range c.Keys {
+		for _, regression := range key.Regressions {
+			fmt.Printf("%s: %s\n", key.Key, regression)
+		}
+	}
+}
+
+func printComparisonRow(width int, name string, baseLatency, latency LatencyHistogram, baseNVPS, nvps, baseFailures, failures float64, regressed bool) {
+	color := "default"
+	if regressed {
+		color = "red"
+	}
+
+	latencyChange := func(p float64) string {
+		return fmt.Sprintf("%s %+.1f%%", formatLatency(latency.Percentile(p)), change(float64(baseLatency.Percentile(p)), float64(latency.Percentile(p))))
+	}
+
+	row := fmt.Sprintf("%-*s :\t%s\t%s\t%s\t%.2f %+.1f%%\t%.2f%% %+.2f",
+		width,
+		name,
+		latencyChange(50),
+		latencyChange(95),
+		latencyChange(99),
+		nvps,
+		change(baseNVPS, nvps),
+		failures,
+		failures-baseFailures)
+	fmt.Println(colorize(color, row))
+}
+
+// change returns the change from a to b in percent.
+func change(a, b float64) float64 {
+	if a == 0 {
+		return 0
+	}
+
+	return 100 * (b - a) / a
+}
+
+func failureRate(stats KeyStats) float64 {
+	return percent(stats.NotSupported+stats.Error, stats.Polls())
+}
+
+func totalFailureRate(stats *ThreadStats) float64 {
+	return percent(stats.UnsupportedValues+stats.ErrorCount, stats.TotalValues+stats.ErrorCount)
+}
+
+// CompareCommand implements the 'compare' command which compares two saved
+// results and exits non-zero if the second regressed from the first.
+func CompareCommand(args []string) {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	addThresholdFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s compare [options] <baseline.json> <results.json>\n", APP)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	thresholds.MinLatencyIncrease = time.Duration(minLatencyMsArg) * time.Millisecond
+
+	base, err := LoadRunReport(flags.Arg(0))
+	PanicOn(err, "Failed to load baseline")
+
+	current, err := LoadRunReport(flags.Arg(1))
+	PanicOn(err, "Failed to load results")
+
+	comparison := Compare(base, current, thresholds)
+	comparison.Print()
+	if comparison.Regressed() {
+		os.Exit(1)
+	}
+}
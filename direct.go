@@ -0,0 +1,214 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunCommand runs the command of a UserParameter with 'sh -c', as the agent
+// does, and returns its output with trailing whitespace removed. The command
+// is killed after the timeout.
+func RunCommand(command string, timeout time.Duration) *Result {
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	result := &Result{Start: time.Now()}
+	timedOut, err := runWithTimeout(cmd, timeout)
+	result.Latency = time.Now().Sub(result.Start)
+	result.Value = strings.TrimRight(out.String(), " \t\r\n")
+
+	// the agent returns the output of commands which exit non-zero
+	if timedOut {
+		result.Err = NewError(nil, "Command timed out after %s", timeout)
+	} else if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		result.Err = NewError(err, "Failed to execute command")
+	}
+
+	return result
+}
+
+// IsLocalHost returns true if the given host, with or without a port, resolves
+// to an address of this host.
+func IsLocalHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// DirectKeyStats holds the results of a single UserParameter key checked
+// through the agent and by running its command directly.
+type DirectKeyStats struct {
+	Agent  KeyStats
+	Direct KeyStats
+
+	// Pairs is the number of times the key was checked both ways.
+	Pairs int64
+
+	// ValueDiffs is the number of pairs with a different value.
+	ValueDiffs int64
+
+	// The most recent pair of differing values
+	LastAgent  string
+	LastDirect string
+}
+
+// Overhead returns the difference between the given percentile of latency
+// through the agent and that of running the command directly.
+func (c DirectKeyStats) Overhead(p float64) time.Duration {
+	return c.Agent.Latency.Percentile(p) - c.Direct.Latency.Percentile(p)
+}
+
+// A DirectTest compares checks of UserParameter keys made through the agent
+// with running the commands of the UserParameters directly, to measure the
+// overhead of the agent.
+type DirectTest struct {
+	mu     sync.Mutex
+	Config *AgentConfig
+	keys   map[string]*DirectKeyStats
+}
+
+// NewDirectTest returns a DirectTest for the UserParameters in the given
+// agent configuration.
+func NewDirectTest(config *AgentConfig) *DirectTest {
+	return &DirectTest{
+		Config: config,
+		keys:   make(map[string]*DirectKeyStats, 0),
+	}
+}
+
+// Matches returns true if the key is a UserParameter.
+func (c *DirectTest) Matches(key string) bool {
+	_, ok, _ := c.Config.Command(key)
+	return ok
+}
+
+// Run runs the command of a UserParameter key. Keys with parameters which the
+// agent does not allow are unsupported, as they are by the agent.
+func (c *DirectTest) Run(key string, timeout time.Duration) *Result {
+	command, _, err := c.Config.Command(key)
+	if err != nil {
+		return &Result{Start: time.Now(), Value: ErrorMessage + "\x00" + err.Error()}
+	}
+
+	return RunCommand(command, timeout)
+}
+
+// Record adds the results of checking a key through the agent and by running
+// its command.
+func (c *DirectTest) Record(key string, agent, direct *Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats, ok := c.keys[key]
+	if !ok {
+		stats = &DirectKeyStats{}
+		c.keys[key] = stats
+	}
+
+	recordKeyStats(&stats.Agent, agent)
+	recordKeyStats(&stats.Direct, direct)
+	stats.Pairs++
+
+	if agent.Err == nil && direct.Err == nil && !agent.Unsupported() && agent.Value != direct.Value {
+		stats.ValueDiffs++
+		stats.LastAgent, stats.LastDirect = describeValue(agent), describeValue(direct)
+	}
+}
+
+// Get returns a copy of the stats of a key.
+func (c *DirectTest) Get(key string) DirectKeyStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stats, ok := c.keys[key]; ok {
+		return *stats
+	}
+
+	return DirectKeyStats{}
+}
+
+// Print prints the latency of each UserParameter key through the agent and
+// when run directly, followed by any keys which returned different values.
+// It returns the number of UserParameter keys checked.
+func (c *DirectTest) Print(keyNames []string, longestKeyName int) int {
+	fmt.Printf("\n=== UserParameter overhead ===\n\n")
+	fmt.Printf("%-*s  \tagent p50\tdirect p50\toverhead\tagent p95\tdirect p95\toverhead\n", longestKeyName, "key")
+	keys := 0
+	for _, name := range keyNames {
+		stats := c.Get(name)
+		if stats.Pairs == 0 {
+			continue
+		}
+		keys++
+
+		row := fmt.Sprintf("%-*s :\t%-10s\t%-10s\t%-10s\t%-10s\t%-10s\t%s\n", longestKeyName, name, formatLatency(stats.Agent.Latency.Percentile(50)), formatLatency(stats.Direct.Latency.Percentile(50)), formatLatency(stats.Overhead(50)), formatLatency(stats.Agent.Latency.Percentile(95)), formatLatency(stats.Direct.Latency.Percentile(95)), formatLatency(stats.Overhead(95)))
+		fmt.Print(row)
+	}
+
+	if keys == 0 {
+		fmt.Printf("No keys matched a UserParameter in %s\n", c.Config.Path)
+	}
+
+	diffs := 0
+	for _, name := range keyNames {
+		stats := c.Get(name)
+		if stats.ValueDiffs == 0 && stats.Agent.Error+stats.Agent.NotSupported == stats.Direct.Error+stats.Direct.NotSupported {
+			continue
+		}
+
+		if diffs == 0 {
+			fmt.Printf("\n=== UserParameters with different results ===\n\n")
+		}
+		diffs++
+
+		row := fmt.Sprintf("%s: %d value differences in %d checks, %.2f%% failed through the agent and %.2f%% directly", colorize("yellow", name), stats.ValueDiffs, stats.Pairs, failureRate(stats.Agent), failureRate(stats.Direct))
+		if stats.ValueDiffs > 0 {
+			row += fmt.Sprintf(" (last agent: %s, direct: %s)", stats.LastAgent, stats.LastDirect)
+		}
+		fmt.Println(row)
+	}
+
+	return keys
+}
@@ -20,7 +20,20 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/mitchellh/colorstring"
+	"io"
+	"net"
 	"os"
+	"strings"
+	"syscall"
+)
+
+// Transport error classes
+const (
+	ErrorClassRefused = "refused"
+	ErrorClassReset   = "reset"
+	ErrorClassTimeout = "timeout"
+	ErrorClassEOF     = "eof"
+	ErrorClassOther   = "other"
 )
 
 type Error struct {
@@ -62,13 +75,94 @@ func (c *Error) Error() string {
 	return buffer.String()
 }
 
+// NotSupportedError is returned when a Zabbix agent responds to a request
+// with ZBX_NOTSUPPORTED.
+type NotSupportedError struct {
+	Key    string
+	Reason string
+}
+
+// NewNotSupportedError returns a NotSupportedError for the given key with the
+// reason, if any, parsed from the agent response.
+func NewNotSupportedError(key string, val string) error {
+	reason := ""
+	if i := strings.Index(val, "\x00"); i >= 0 {
+		reason = val[i+1:]
+	}
+
+	return &NotSupportedError{
+		Key:    key,
+		Reason: reason,
+	}
+}
+
+func (c *NotSupportedError) Error() string {
+	if c.Reason != "" {
+		return fmt.Sprintf("Item unsupported: %s (%s)", c.Key, c.Reason)
+	}
+
+	return fmt.Sprintf("Item unsupported: %s", c.Key)
+}
+
+// IsNotSupported returns true if the given error, or any error it wraps, is a
+// NotSupportedError.
+func IsNotSupported(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *NotSupportedError:
+			return true
+		case *Error:
+			err = e.InnerError
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+// ErrorClass returns the class of a transport error returned by Get, such as
+// ErrorClassRefused or ErrorClassTimeout.
+func ErrorClass(err error) string {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrorClassEOF
+	}
+
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return ErrorClassTimeout
+	}
+
+	// unwrap the underlying system call error
+	if operr, ok := err.(*net.OpError); ok {
+		err = operr.Err
+	}
+	if syserr, ok := err.(*os.SyscallError); ok {
+		err = syserr.Err
+	}
+
+	switch err {
+	case syscall.ECONNREFUSED:
+		return ErrorClassRefused
+	case syscall.ECONNRESET, syscall.EPIPE, syscall.ECONNABORTED:
+		return ErrorClassReset
+	}
+
+	return ErrorClassOther
+}
+
 func PrintError(err error) {
 	colorstring.Fprintf(os.Stderr, "[red]Error:[default] %s\n", err.Error())
 }
 
+func PrintWarning(err error) {
+	colorstring.Fprintf(os.Stderr, "[yellow]Warning:[default] %s\n", err.Error())
+}
+
+// PanicOn prints the error, if any, and exits, running the after hook if the
+// run had started.
 func PanicOn(err error, format string, a ...interface{}) {
 	if err != nil {
 		PrintError(NewError(err, format, a...))
-		os.Exit(1)
+		hooks.Exit(1)
 	}
 }
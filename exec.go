@@ -0,0 +1,54 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+// runWithTimeout runs the given command in its own process group and waits for
+// it to exit. If the command is still running after the timeout, the whole
+// process group is killed so children of the command can not hold its output
+// open, and timedOut is true. A timeout of zero waits indefinitely.
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) (timedOut bool, err error) {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	if timeout <= 0 {
+		return false, <-done
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return false, err
+
+	case <-timer.C:
+		killProcessGroup(cmd)
+		return true, <-done
+	}
+}
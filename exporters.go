@@ -0,0 +1,239 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// A LineOutput writes lines of text to a file or to a TCP or UDP endpoint,
+// given as a path or as 'tcp://host:port' or 'udp://host:port'.
+type LineOutput struct {
+	Dest    string
+	network string
+	addr    string
+	w       io.WriteCloser
+}
+
+// NewLineOutput opens the given destination for writing.
+func NewLineOutput(dest string) (*LineOutput, error) {
+	c := &LineOutput{Dest: dest}
+
+	for _, network := range []string{"tcp", "udp"} {
+		if strings.HasPrefix(dest, network+"://") {
+			c.network = network
+			c.addr = dest[len(network)+3:]
+		}
+	}
+
+	var err error
+	if c.network == "" {
+		c.w, err = os.Create(dest)
+	} else {
+		c.w, err = net.Dial(c.network, c.addr)
+	}
+
+	if err != nil {
+		return nil, NewError(err, "Failed to open %s", dest)
+	}
+
+	return c, nil
+}
+
+// WriteLines writes the given lines. Each line is sent in its own datagram
+// to UDP endpoints. TCP endpoints are reconnected once if the write fails.
+func (c *LineOutput) WriteLines(lines []string) error {
+	if c.network == "udp" {
+		for _, line := range lines {
+			if _, err := io.WriteString(c.w, line+"\n"); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	buf := strings.Join(lines, "\n") + "\n"
+	_, err := io.WriteString(c.w, buf)
+	if err != nil && c.network == "tcp" {
+		dprintf("Reconnecting to %s after error: %v\n", c.Dest, err)
+		c.w.Close()
+		if c.w, err = net.Dial(c.network, c.addr); err != nil {
+			return err
+		}
+		_, err = io.WriteString(c.w, buf)
+	}
+
+	return err
+}
+
+// Close closes the file or connection.
+func (c *LineOutput) Close() error {
+	return c.w.Close()
+}
+
+// InfluxWriter writes samples in InfluxDB line protocol, as a point for the
+// totals and a point for each key, tagged with the agent host.
+type InfluxWriter struct {
+	*LineOutput
+	Measurement string
+	Host        string
+}
+
+// NewInfluxWriter returns an InfluxWriter which writes to the given
+// destination.
+func NewInfluxWriter(dest, host string) (*InfluxWriter, error) {
+	out, err := NewLineOutput(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InfluxWriter{
+		LineOutput:  out,
+		Measurement: APP,
+		Host:        host,
+	}, nil
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// WriteSample writes all points of a sample.
+func (c *InfluxWriter) WriteSample(sample *Sample) error {
+	points := sample.Points()
+	lines := make([]string, 0, len(points))
+	for _, point := range points {
+		tags := ",host=" + influxTagEscaper.Replace(c.Host)
+		if point.Key != TotalsSeriesName {
+			tags += ",key=" + influxTagEscaper.Replace(point.Key)
+		}
+
+		lines = append(lines, fmt.Sprintf("%s%s requests=%di,success=%di,unsupported=%di,errors=%di,rate=%s,mean_ms=%s,p50_ms=%s,p95_ms=%s,p99_ms=%s %d",
+			c.Measurement,
+			tags,
+			point.Requests,
+			point.Success,
+			point.Unsupported,
+			point.Errors,
+			formatMetric(point.Rate),
+			formatMetric(point.MeanMs),
+			formatMetric(point.P50Ms),
+			formatMetric(point.P95Ms),
+			formatMetric(point.P99Ms),
+			point.Time.UnixNano()))
+	}
+
+	return c.WriteLines(lines)
+}
+
+// GraphiteWriter writes samples in the Graphite plaintext protocol, as
+// '<prefix>.<host>.<key>.<metric>' with the totals named 'all'.
+type GraphiteWriter struct {
+	*LineOutput
+	Prefix string
+	Host   string
+}
+
+// NewGraphiteWriter returns a GraphiteWriter which writes to the given
+// destination.
+func NewGraphiteWriter(dest, prefix, host string) (*GraphiteWriter, error) {
+	out, err := NewLineOutput(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GraphiteWriter{
+		LineOutput: out,
+		Prefix:     prefix,
+		Host:       host,
+	}, nil
+}
+
+// graphiteTotals is the Graphite path component of the totals of all keys.
+const graphiteTotals = "all"
+
+var (
+	graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_\-]+`)
+
+	// graphiteSimpleKey matches keys which may be named in Graphite by
+	// replacing their dots with underscores, without losing information.
+	graphiteSimpleKey = regexp.MustCompile(`^[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)*$`)
+)
+
+// graphiteName returns s with any characters which are not safe in a
+// Graphite path component replaced with underscores.
+func graphiteName(s string) string {
+	return strings.Trim(graphiteUnsafe.ReplaceAllString(s, "_"), "_")
+}
+
+// graphiteKey returns the Graphite path component of a key. Keys of letters,
+// digits, hyphens and single dots are named with their dots replaced with
+// underscores. Any other key, such as one with parameters, is named with its
+// graphiteName followed by '__' and a hash of the key, so that keys which
+// differ only in replaced characters, or a key named like the totals, do not
+// share a series.
+func graphiteKey(key string) string {
+	if key != graphiteTotals && graphiteSimpleKey.MatchString(key) {
+		return strings.Replace(key, ".", "_", -1)
+	}
+
+	sum := sha1.Sum([]byte(key))
+	return graphiteName(key) + "__" + hex.EncodeToString(sum[:4])
+}
+
+// WriteSample writes all points of a sample.
+func (c *GraphiteWriter) WriteSample(sample *Sample) error {
+	points := sample.Points()
+	lines := make([]string, 0, len(points)*9)
+	for _, point := range points {
+		name := graphiteTotals
+		if point.Key != TotalsSeriesName {
+			name = graphiteKey(point.Key)
+		}
+
+		path := graphiteName(c.Host) + "." + name
+		if c.Prefix != "" {
+			path = c.Prefix + "." + path
+		}
+
+		ts := point.Time.Unix()
+		for _, metric := range []struct {
+			name  string
+			value float64
+		}{
+			{"requests", float64(point.Requests)},
+			{"success", float64(point.Success)},
+			{"unsupported", float64(point.Unsupported)},
+			{"errors", float64(point.Errors)},
+			{"rate", point.Rate},
+			{"mean_ms", point.MeanMs},
+			{"p50_ms", point.P50Ms},
+			{"p95_ms", point.P95Ms},
+			{"p99_ms", point.P99Ms},
+		} {
+			lines = append(lines, fmt.Sprintf("%s.%s %s %d", path, metric.name, formatMetric(metric.value), ts))
+		}
+	}
+
+	return c.WriteLines(lines)
+}
@@ -0,0 +1,238 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifecycle hooks
+const (
+	HookBefore     = "before"
+	HookStage      = "stage"
+	HookFirstError = "first-error"
+	HookAfter      = "after"
+	HookRestart    = "restart"
+)
+
+// hookOutputLimit is the number of bytes at the end of the output of a hook
+// which are kept.
+const hookOutputLimit = 64 * 1024
+
+// A HookResult is the outcome of running a hook command.
+type HookResult struct {
+	Hook     string
+	Stage    string
+	Command  string
+	Start    time.Time
+	Duration time.Duration
+	ExitCode int
+	Output   string
+	Error    string
+}
+
+// Failed returns true if the command could not be run or exited non-zero.
+func (c *HookResult) Failed() bool {
+	return c.Error != "" || c.ExitCode != 0
+}
+
+// Describe returns a short description of the outcome of a hook.
+func (c *HookResult) Describe() string {
+	if c.Error != "" {
+		return c.Error
+	}
+
+	return fmt.Sprintf("exit code %d", c.ExitCode)
+}
+
+// RunHook runs a command with 'sh -c' and returns its combined output and
+// exit code. The command is killed if it runs for longer than the timeout, if
+// non-zero. The given environment variables are added to those of this
+// process, along with BENCH_HOOK and BENCH_HOST.
+func RunHook(hook, command string, timeout time.Duration, env ...string) *HookResult {
+	result := &HookResult{
+		Hook:    hook,
+		Command: command,
+		Start:   time.Now(),
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "BENCH_HOOK="+hook, "BENCH_HOST="+host)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	dprintf("Running %s hook: %s\n", hook, command)
+	timedOut, err := runWithTimeout(cmd, timeout)
+	result.Duration = time.Now().Sub(result.Start)
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+	}
+	if timedOut {
+		result.Error = fmt.Sprintf("timed out after %s", timeout)
+	} else if err != nil && result.ExitCode == 0 {
+		result.Error = err.Error()
+	}
+
+	result.Output = out.String()
+	if len(result.Output) > hookOutputLimit {
+		result.Output = result.Output[len(result.Output)-hookOutputLimit:]
+	}
+
+	return result
+}
+
+// Hooks runs user commands at points in the lifecycle of a run and keeps
+// their results for the report. Hooks with no command are skipped.
+type Hooks struct {
+	mu         sync.Mutex
+	Before     string
+	Stage      string
+	FirstError string
+	After      string
+	Timeout    time.Duration
+	results    []*HookResult
+	started    bool
+	firstError sync.Once
+	after      sync.Once
+	wg         sync.WaitGroup
+}
+
+// run runs a hook and records its result.
+func (c *Hooks) run(hook, command, stage string, env ...string) *HookResult {
+	if command == "" {
+		return nil
+	}
+
+	env = append(env, "BENCH_STAGE="+stage)
+	result := RunHook(hook, command, c.Timeout, env...)
+	result.Stage = stage
+
+	c.mu.Lock()
+	c.results = append(c.results, result)
+	c.mu.Unlock()
+
+	if result.Failed() {
+		PrintWarning(NewError(nil, "%s hook failed: %s", hook, result.Describe()))
+	}
+	if verbose && result.Output != "" {
+		fmt.Printf("[%s] %s", hook, result.Output)
+	}
+
+	return result
+}
+
+// RunBefore runs the before hook and returns an error if it failed. Once it
+// has succeeded, the after hook is run by Exit.
+func (c *Hooks) RunBefore() error {
+	if result := c.run(HookBefore, c.Before, "before"); result != nil && result.Failed() {
+		return NewError(nil, "%s: %s", result.Describe(), strings.TrimSpace(result.Output))
+	}
+
+	c.mu.Lock()
+	c.started = true
+	c.mu.Unlock()
+
+	return nil
+}
+
+// RunStage runs the stage hook before the named stage starts.
+func (c *Hooks) RunStage(stage string) {
+	c.run(HookStage, c.Stage, stage)
+}
+
+// RunFirstError runs the first error hook in the background, the first time
+// it is called. The key and error are given to the hook as BENCH_KEY and
+// BENCH_ERROR.
+func (c *Hooks) RunFirstError(key string, err error) {
+	if c.FirstError == "" {
+		return
+	}
+
+	c.firstError.Do(func() {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.run(HookFirstError, c.FirstError, "first error", "BENCH_KEY="+key, "BENCH_ERROR="+err.Error())
+		}()
+	})
+}
+
+// RunAfter waits for any first error hook to finish and then runs the after
+// hook. The after hook is only run once.
+func (c *Hooks) RunAfter() {
+	c.after.Do(func() {
+		c.wg.Wait()
+		c.run(HookAfter, c.After, "after")
+	})
+}
+
+// Exit runs the after hook, if the before hook succeeded and the after hook
+// has not been run, and exits with the given code. It is safe to call on nil
+// Hooks, before they are configured.
+func (c *Hooks) Exit(code int) {
+	if c != nil {
+		c.mu.Lock()
+		started := c.started
+		c.mu.Unlock()
+
+		if started {
+			c.RunAfter()
+		}
+	}
+
+	os.Exit(code)
+}
+
+// Results returns the results of all hooks run so far.
+func (c *Hooks) Results() []*HookResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.results
+}
+
+// Print prints the outcome of each hook which was run and returns the number
+// which failed.
+func (c *Hooks) Print() int {
+	results := c.Results()
+	if len(results) == 0 {
+		return 0
+	}
+
+	fmt.Printf("\n=== Hooks ===\n\n")
+	failed := 0
+	for _, result := range results {
+		color := "green"
+		if result.Failed() {
+			color = "red"
+			failed++
+		}
+
+		fmt.Printf("%-11s :\t%-16s\t%s\t%s\t%s\n", result.Hook, result.Stage, colorize(color, result.Describe()), result.Duration/time.Millisecond*time.Millisecond, result.Command)
+	}
+
+	return failed
+}
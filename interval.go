@@ -0,0 +1,419 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An UpdateInterval is a Zabbix item update interval, made up of a default
+// delay and optional flexible and scheduling intervals.
+//
+// E.g. '1m;30s/1-5,09:00-18:00;wd1-5h9' polls every minute, every 30 seconds
+// during business hours and at 09:00:00 on every weekday.
+type UpdateInterval struct {
+	Delay      time.Duration
+	Flexible   []FlexibleInterval
+	Scheduling []*ScheduleFilter
+}
+
+// A FlexibleInterval overrides the default delay of an UpdateInterval during
+// a time period. A zero delay disables polling during the period.
+type FlexibleInterval struct {
+	Delay  time.Duration
+	Period TimePeriod
+}
+
+// A TimePeriod is a recurring window of time.
+type TimePeriod interface {
+	Contains(t time.Time) bool
+}
+
+// A DayTimePeriod is a time period in the Zabbix format 'd[-d],hh:mm-hh:mm'
+// where days are numbered 1 (Monday) to 7 (Sunday).
+type DayTimePeriod struct {
+	FromDay, ToDay int
+	From, To       time.Duration
+}
+
+// A ScheduleFilter is a Zabbix scheduling interval such as 'wd1-5h9m30'. Each
+// field lists the matching values of a time unit, or is nil if the unit was
+// not specified.
+type ScheduleFilter struct {
+	MonthDays []int
+	WeekDays  []int
+	Hours     []int
+	Minutes   []int
+	Seconds   []int
+}
+
+var (
+	durationPattern = regexp.MustCompile(`^(\d+)([smhdw]?)$`)
+	periodPattern   = regexp.MustCompile(`^([1-7])(?:-([1-7]))?,(\d{1,2}):(\d{2})-(\d{1,2}):(\d{2})$`)
+	schedulePattern = regexp.MustCompile(`^(?:md([0-9,/-]*))?(?:wd([0-9,/-]*))?(?:h([0-9,/-]*))?(?:m([0-9,/-]*))?(?:s([0-9,/-]*))?$`)
+)
+
+// ParseDuration parses a Zabbix time duration with an optional unit suffix
+// such as '30', '30s', '5m', '1h', '1d' or '1w'.
+func ParseDuration(s string) (time.Duration, error) {
+	m := durationPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, NewError(nil, "Invalid duration: %s", s)
+	}
+
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, NewError(err, "Invalid duration: %s", s)
+	}
+
+	unit := time.Second
+	switch m[2] {
+	case "m":
+		unit = time.Minute
+	case "h":
+		unit = time.Hour
+	case "d":
+		unit = 24 * time.Hour
+	case "w":
+		unit = 7 * 24 * time.Hour
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// ParseUpdateInterval parses a Zabbix item update interval. Intervals are
+// separated by ';' and the first must be the default delay.
+//
+// Flexible intervals take the form 'delay/period' where the period is either
+// 'd[-d],hh:mm-hh:mm' or a scheduling filter. For convenience, a scheduling
+// filter followed by a delay with a unit suffix, such as 'wd1-5h9-18/30s', is
+// also accepted as a flexible interval.
+func ParseUpdateInterval(s string) (*UpdateInterval, error) {
+	parts := strings.Split(s, ";")
+	delay, err := ParseDuration(parts[0])
+	if err != nil {
+		return nil, NewError(err, "Invalid update interval: %s", s)
+	}
+
+	interval := &UpdateInterval{Delay: delay}
+	for _, part := range parts[1:] {
+		if flex, ok := parseFlexibleInterval(part); ok {
+			interval.Flexible = append(interval.Flexible, flex)
+			continue
+		}
+
+		filter, err := ParseScheduleFilter(part)
+		if err != nil {
+			return nil, NewError(err, "Invalid update interval: %s", s)
+		}
+		interval.Scheduling = append(interval.Scheduling, filter)
+	}
+
+	if interval.Delay == 0 && len(interval.Flexible) == 0 && len(interval.Scheduling) == 0 {
+		return nil, NewError(nil, "Update interval never polls: %s", s)
+	}
+
+	return interval, nil
+}
+
+// parseFlexibleInterval attempts to parse a flexible interval in either the
+// 'delay/period' or 'schedule/delay' form.
+func parseFlexibleInterval(s string) (FlexibleInterval, bool) {
+	i := strings.LastIndex(s, "/")
+	if i < 0 {
+		return FlexibleInterval{}, false
+	}
+
+	if delay, err := ParseDuration(s[:i]); err == nil {
+		if period, err := parseTimePeriod(s[i+1:]); err == nil {
+			return FlexibleInterval{Delay: delay, Period: period}, true
+		}
+	}
+
+	// scheduling filter steps never have a unit suffix
+	if suffix := s[len(s)-1]; suffix >= 'a' && suffix <= 'z' {
+		if delay, err := ParseDuration(s[i+1:]); err == nil {
+			if period, err := parseTimePeriod(s[:i]); err == nil {
+				return FlexibleInterval{Delay: delay, Period: period}, true
+			}
+		}
+	}
+
+	return FlexibleInterval{}, false
+}
+
+func parseTimePeriod(s string) (TimePeriod, error) {
+	m := periodPattern.FindStringSubmatch(s)
+	if m == nil {
+		return ParseScheduleFilter(s)
+	}
+
+	period := &DayTimePeriod{}
+	period.FromDay, _ = strconv.Atoi(m[1])
+	period.ToDay = period.FromDay
+	if m[2] != "" {
+		period.ToDay, _ = strconv.Atoi(m[2])
+	}
+
+	fields := make([]int, 4)
+	for i := range fields {
+		fields[i], _ = strconv.Atoi(m[i+3])
+	}
+	period.From = time.Duration(fields[0])*time.Hour + time.Duration(fields[1])*time.Minute
+	period.To = time.Duration(fields[2])*time.Hour + time.Duration(fields[3])*time.Minute
+
+	if period.FromDay > period.ToDay || period.From >= period.To || period.To > 24*time.Hour {
+		return nil, NewError(nil, "Invalid time period: %s", s)
+	}
+
+	return period, nil
+}
+
+// Contains returns true if t falls within the time period.
+func (c *DayTimePeriod) Contains(t time.Time) bool {
+	day := int(t.Weekday())
+	if day == 0 {
+		day = 7
+	}
+
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	return day >= c.FromDay && day <= c.ToDay && sinceMidnight >= c.From && sinceMidnight < c.To
+}
+
+// ParseScheduleFilter parses a Zabbix scheduling interval such as
+// 'md1-15wd1-5h9-17m0-59/15'. Each unit accepts a comma separated list of
+// values or ranges with an optional step.
+func ParseScheduleFilter(s string) (*ScheduleFilter, error) {
+	m := schedulePattern.FindStringSubmatchIndex(s)
+	if s == "" || m == nil {
+		return nil, NewError(nil, "Invalid scheduling interval: %s", s)
+	}
+
+	limits := [][2]int{{1, 31}, {1, 7}, {0, 23}, {0, 59}, {0, 59}}
+	filter := &ScheduleFilter{}
+	fields := []*[]int{&filter.MonthDays, &filter.WeekDays, &filter.Hours, &filter.Minutes, &filter.Seconds}
+
+	for i, field := range fields {
+		// only parse units which are present in the filter
+		start, end := m[2*i+2], m[2*i+3]
+		if start < 0 {
+			continue
+		}
+
+		values, err := parseScheduleValues(s[start:end], limits[i][0], limits[i][1])
+		if err != nil {
+			return nil, NewError(err, "Invalid scheduling interval: %s", s)
+		}
+		*field = values
+	}
+
+	return filter, nil
+}
+
+// parseScheduleValues expands a scheduling filter such as '1-5,10-20/2' into
+// the list of matching values.
+func parseScheduleValues(s string, min, max int) ([]int, error) {
+	matches := make([]bool, max+1)
+	for _, part := range strings.Split(s, ",") {
+		from, to, step := min, max, 1
+
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, NewError(err, "Invalid step: %s", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		if part != "" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, NewError(err, "Invalid value: %s", part)
+			}
+			from, to = n, n
+
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, NewError(err, "Invalid value: %s", part)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return nil, NewError(nil, "Value out of range %d-%d: %s", min, max, part)
+		}
+
+		for v := from; v <= to; v += step {
+			matches[v] = true
+		}
+	}
+
+	values := []int{}
+	for v, ok := range matches {
+		if ok {
+			values = append(values, v)
+		}
+	}
+
+	return values, nil
+}
+
+// units returns the candidate values of each of the hour, minute and second
+// units of a scheduling filter. Units below the smallest specified unit
+// default to zero. Units above it match any value.
+func (c *ScheduleFilter) units() [3][]int {
+	fields := [3][]int{c.Hours, c.Minutes, c.Seconds}
+	limits := [3]int{23, 59, 59}
+
+	lowest := -1
+	for i, field := range fields {
+		if field != nil {
+			lowest = i
+		}
+	}
+
+	var units [3][]int
+	for i, field := range fields {
+		switch {
+		case field != nil:
+			units[i] = field
+		case i < lowest:
+			units[i] = make([]int, limits[i]+1)
+			for v := range units[i] {
+				units[i][v] = v
+			}
+		default:
+			units[i] = []int{0}
+		}
+	}
+
+	return units
+}
+
+func (c *ScheduleFilter) matchesDay(t time.Time) bool {
+	if c.MonthDays != nil && !containsInt(c.MonthDays, t.Day()) {
+		return false
+	}
+
+	day := int(t.Weekday())
+	if day == 0 {
+		day = 7
+	}
+
+	return c.WeekDays == nil || containsInt(c.WeekDays, day)
+}
+
+// Contains returns true if t matches every specified unit of the filter when
+// the filter is used as the period of a flexible interval.
+func (c *ScheduleFilter) Contains(t time.Time) bool {
+	return c.matchesDay(t) &&
+		(c.Hours == nil || containsInt(c.Hours, t.Hour())) &&
+		(c.Minutes == nil || containsInt(c.Minutes, t.Minute())) &&
+		(c.Seconds == nil || containsInt(c.Seconds, t.Second()))
+}
+
+// Next returns the first time after t which matches the scheduling filter, or
+// a zero time if no match is found within a year.
+func (c *ScheduleFilter) Next(t time.Time) time.Time {
+	units := c.units()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for i := 0; i < 366; i++ {
+		if c.matchesDay(day) {
+			for _, h := range units[0] {
+				for _, m := range units[1] {
+					for _, s := range units[2] {
+						next := time.Date(day.Year(), day.Month(), day.Day(), h, m, s, 0, t.Location())
+						if next.After(t) {
+							return next
+						}
+					}
+				}
+			}
+		}
+
+		day = day.AddDate(0, 0, 1)
+	}
+
+	return time.Time{}
+}
+
+// DelayAt returns the polling delay in effect at time t. If several flexible
+// intervals are active, the shortest delay is used.
+func (c *UpdateInterval) DelayAt(t time.Time) time.Duration {
+	delay := time.Duration(-1)
+	for _, flex := range c.Flexible {
+		if flex.Period.Contains(t) && (delay < 0 || flex.Delay < delay) {
+			delay = flex.Delay
+		}
+	}
+
+	if delay < 0 {
+		return c.Delay
+	}
+
+	return delay
+}
+
+// Next returns the next time after t at which an item with this update
+// interval should be polled. Polls at regular intervals are aligned to the
+// given offset, in the same way the Zabbix server spreads items with the
+// same interval using their item ID.
+func (c *UpdateInterval) Next(t time.Time, offset time.Duration) time.Time {
+	var next time.Time
+
+	// find the next time the item is polled on a regular interval, skipping
+	// periods where polling is disabled
+	for i, at := 0, t; i < 7*24*60; i, at = i+1, at.Add(time.Minute).Truncate(time.Minute) {
+		delay := c.DelayAt(at)
+		if delay <= 0 {
+			continue
+		}
+
+		sinceEpoch := time.Duration(at.UnixNano())
+		next = at.Add((delay - (sinceEpoch+offset)%delay) % delay)
+		if !next.After(t) {
+			next = next.Add(delay)
+		}
+		break
+	}
+
+	// scheduling intervals take precedence if sooner
+	for _, filter := range c.Scheduling {
+		if s := filter.Next(t); !s.IsZero() && (next.IsZero() || s.Before(next)) {
+			next = s
+		}
+	}
+
+	return next
+}
+
+func containsInt(a []int, v int) bool {
+	for _, n := range a {
+		if n == v {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,237 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultIsolationIterations is the number of iterations of each key in
+	// isolation mode if -iterations is not given.
+	DefaultIsolationIterations = 100
+
+	// isolationSettle is the time allowed for the agent to release resources
+	// held for a request before it is sampled.
+	isolationSettle = time.Second
+)
+
+// An IsolationGroup is a set of keys checked on their own in isolation mode;
+// either a single key, or a discovery rule and all of its prototypes.
+type IsolationGroup struct {
+	Name string
+	Keys ItemKeys
+}
+
+// IsolationGroups returns the keys grouped for isolation mode. Prototypes are
+// grouped with the discovery rule which discovered them, in the order in which
+// each rule or key first appears.
+func (c ItemKeys) IsolationGroups() []*IsolationGroup {
+	groups := make([]*IsolationGroup, 0)
+	byName := make(map[string]*IsolationGroup)
+	add := func(name string, key *ItemKey) {
+		group, ok := byName[name]
+		if !ok {
+			group = &IsolationGroup{Name: name, Keys: ItemKeys{}}
+			byName[name] = group
+			groups = append(groups, group)
+		}
+		group.Keys = append(group.Keys, key)
+	}
+
+	for _, key := range c {
+		if key.IsPrototype && len(key.Origins) > 0 && key.Origins[0].Rule != "" {
+			add(key.Origins[0].Rule, key)
+		} else {
+			add(key.Key, key)
+		}
+	}
+
+	return groups
+}
+
+// An IsolationResult is the growth in resources used by the agent while a
+// group of keys was checked on its own.
+type IsolationResult struct {
+	Name      string
+	Keys      int
+	Checks    int64
+	Failures  int64
+	Restarted bool
+	Before    *ProcessSample
+	After     *ProcessSample
+}
+
+// FDs returns the growth in open file descriptors.
+func (c *IsolationResult) FDs() int64 {
+	return c.After.FDs - c.Before.FDs
+}
+
+// RSS returns the growth in resident memory in bytes.
+func (c *IsolationResult) RSS() int64 {
+	return c.After.RSS - c.Before.RSS
+}
+
+// Threads returns the growth in threads.
+func (c *IsolationResult) Threads() int64 {
+	return c.After.Threads - c.Before.Threads
+}
+
+// Processes returns the growth in processes.
+func (c *IsolationResult) Processes() int64 {
+	return c.After.Processes - c.Before.Processes
+}
+
+// RankIsolationResults sorts results by the growth in open files, then
+// memory, threads and processes, largest first. Results in which the agent
+// restarted are ranked first as the growth is unknown.
+func RankIsolationResults(results []*IsolationResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Restarted != b.Restarted {
+			return a.Restarted
+		}
+		if a.FDs() != b.FDs() {
+			return a.FDs() > b.FDs()
+		}
+		if a.RSS() != b.RSS() {
+			return a.RSS() > b.RSS()
+		}
+		if a.Threads() != b.Threads() {
+			return a.Threads() > b.Threads()
+		}
+		return a.Processes() > b.Processes()
+	})
+}
+
+// Isolate checks each group of keys on its own with the given number of
+// threads, for iterationLimit iterations, and samples the agent process
+// before and after each group. Groups are checked until all are done or the
+// run is stopped.
+func Isolate(groups []*IsolationGroup, procMonitor *ProcessMonitor, threads int) ([]*IsolationResult, error) {
+	results := make([]*IsolationResult, 0, len(groups))
+	for i, group := range groups {
+		if stop {
+			break
+		}
+
+		hooks.RunStage("isolate " + group.Name)
+		fmt.Printf("Isolating %d/%d: %s (%d keys)\n", i+1, len(groups), group.Name, len(group.Keys))
+		before, err := procMonitor.Sample()
+		if err != nil {
+			return results, err
+		}
+
+		stats := CheckKeys(group.Keys, threads)
+
+		time.Sleep(isolationSettle)
+		after, err := procMonitor.Sample()
+		if err != nil {
+			return results, err
+		}
+
+		results = append(results, &IsolationResult{
+			Name:      group.Name,
+			Keys:      len(group.Keys),
+			Checks:    stats.TotalValues + stats.ErrorCount,
+			Failures:  stats.UnsupportedValues + stats.ErrorCount,
+			Restarted: before.PID != after.PID,
+			Before:    before,
+			After:     after,
+		})
+	}
+
+	return results, nil
+}
+
+// PrintIsolationResults prints the ranked results of isolation mode and
+// returns the number of groups in which any resource grew.
+func PrintIsolationResults(results []*IsolationResult) int {
+	names := make([]string, len(results))
+	longest := 3
+	for i, result := range results {
+		names[i] = result.Name
+		if result.Keys > 1 {
+			names[i] = fmt.Sprintf("%s (%d keys)", result.Name, result.Keys)
+		}
+		if len(names[i]) > longest {
+			longest = len(names[i])
+		}
+	}
+
+	fmt.Printf("\n=== Key isolation ===\n\n")
+	fmt.Printf("%-*s  \tchecks\tfailed\tfiles\tRSS\t\tthreads\tprocs\n", longest, "key")
+	grew := 0
+	for i, result := range results {
+		if result.Restarted {
+			grew++
+			restarted := fmt.Sprintf("agent restarted (PID %d to %d)", result.Before.PID, result.After.PID)
+			fmt.Printf("%-*s :\t%d\t%d\t%s\n", longest, names[i], result.Checks, result.Failures, colorize("red", restarted))
+			continue
+		}
+
+		color := "default"
+		if result.FDs() > 0 || result.RSS() > 0 || result.Threads() > 0 || result.Processes() > 0 {
+			grew++
+			color = "yellow"
+		}
+
+		name := colorize(color, fmt.Sprintf("%-*s", longest, names[i]))
+		fmt.Printf("%s :\t%d\t%s\t%+d\t%+.1fMiB\t%+d\t%+d\n", name, result.Checks, hl(result.Failures, "red"), result.FDs(), float64(result.RSS())/(1<<20), result.Threads(), result.Processes())
+	}
+
+	return grew
+}
+
+// IsolateCommand checks each group of keys on its own, prints the groups
+// ranked by the growth of the agent process resources and exits.
+func IsolateCommand(keys ItemKeys) {
+	if agentPID <= 0 && agentPIDFile == "" {
+		fmt.Fprintf(os.Stderr, "Isolation mode requires -agent-pid or -agent-pidfile\n")
+		hooks.Exit(1)
+	}
+
+	if iterationLimit <= 0 {
+		iterationLimit = DefaultIsolationIterations
+	}
+
+	groups := keys.IsolationGroups()
+	fmt.Printf("Isolating %d keys in %d groups for %d iterations with %d threads (press Ctrl-C to cancel)...\n", len(keys), len(groups), iterationLimit, threadCount)
+	HandleSignals()
+
+	procMonitor := NewProcessMonitor(agentPID, agentPIDFile, 0)
+	results, err := Isolate(groups, procMonitor, threadCount)
+	if err != nil {
+		PrintError(NewError(err, "Failed to sample agent process"))
+	}
+
+	hooks.RunAfter()
+
+	RankIsolationResults(results)
+	grew := PrintIsolationResults(results)
+	hooks.Print()
+	fmt.Printf("\nTotal groups isolated:\t\t%d\n", len(results))
+	fmt.Printf("Total groups with growth:\t%d\n", grew)
+
+	if err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -18,9 +18,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -31,6 +34,42 @@ type ItemKey struct {
 	IsDiscoveryRule bool
 	IsPrototype     bool
 	Prototypes      ItemKeys
+
+	// Origins lists every location where this key was defined.
+	Origins []KeyOrigin
+
+	// Weight is the relative frequency with which this key is scheduled when
+	// using a weighted schedule. Interval is the Zabbix update interval of the
+	// key and, if set, overrides Weight.
+	Weight   float64
+	Interval *UpdateInterval
+
+	// Timeout overrides the default timeout of requests for this key if
+	// non-zero.
+	Timeout time.Duration
+
+	// Value is the kind of value expected from this key when values are
+	// tracked; const, counter or any. If empty, the kind is guessed from the
+	// key name.
+	Value string
+
+	// Match is the rule used to compare responses of this key with a
+	// snapshot. If nil, responses must match exactly.
+	Match *MatchRule
+
+	// DiscoveryError is the last error returned while executing this
+	// discovery rule, if discovery failed.
+	DiscoveryError error
+}
+
+// A KeyOrigin describes where an ItemKey was defined; either a line in a key
+// file, a discovery rule and the macro values used to expand a prototype, or
+// the command line.
+type KeyOrigin struct {
+	File   string
+	Line   int
+	Rule   string
+	Macros map[string]string
 }
 
 // ItemKeys is an array of pointers to ItemKey structs
@@ -51,6 +90,25 @@ var (
 	indentPattern = regexp.MustCompile(`^\s+`)
 )
 
+// String returns a short human readable description of a key origin.
+func (c KeyOrigin) String() string {
+	if c.Rule != "" {
+		macros := []string{}
+		for macro, val := range c.Macros {
+			macros = append(macros, fmt.Sprintf("%s=%s", macro, val))
+		}
+		sort.Strings(macros)
+
+		return fmt.Sprintf("%s (%s)", c.Rule, strings.Join(macros, ", "))
+	}
+
+	if c.File != "" {
+		return fmt.Sprintf("%s:%d", c.File, c.Line)
+	}
+
+	return "command line"
+}
+
 // NewItemKey returns a pointer to a new instance of an ItemKey with
 // environment variables in the key name expanded.
 func NewItemKey(key string) *ItemKey {
@@ -59,9 +117,274 @@ func NewItemKey(key string) *ItemKey {
 		IsDiscoveryRule: false,
 		IsPrototype:     false,
 		Prototypes:      make(ItemKeys, 0),
+		Weight:          1,
 	}
 }
 
+// SplitKeyLine splits a line from a key file into the item key and any
+// trailing attributes. The key ends at the first whitespace character which is
+// not inside the key parameters.
+//
+// E.g. 'vfs.file.exists["/tmp/my file"] weight=2' returns
+// 'vfs.file.exists["/tmp/my file"]' and 'weight=2'.
+func SplitKeyLine(line string) (string, string) {
+	indent := indentPattern.FindString(line)
+	line = line[len(indent):]
+
+	depth := 0
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"' && depth > 0:
+			quoted = !quoted
+		case quoted:
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case depth == 0 && (c == ' ' || c == '\t'):
+			return indent + line[:i], strings.TrimSpace(line[i:])
+		}
+	}
+
+	return indent + line, ""
+}
+
+// ParseKeyParams splits an item key into its name and parameters. Quoted
+// parameters are unquoted, with only '\"' escaped, and unquoted parameters
+// have leading spaces removed, as done by the Zabbix agent. Array parameters
+// are returned with their brackets.
+//
+// E.g. 'vfs.fs.size["/my fs", free]' returns 'vfs.fs.size' and '/my fs' and
+// 'free'.
+func ParseKeyParams(key string) (string, []string, error) {
+	i := strings.Index(key, "[")
+	if i < 0 {
+		return key, nil, nil
+	}
+	if !strings.HasSuffix(key, "]") {
+		return "", nil, NewError(nil, "Invalid parameters in key: %s", key)
+	}
+
+	name, s := key[:i], key[i+1:len(key)-1]
+	params := make([]string, 0)
+	for {
+		s = strings.TrimLeft(s, " ")
+
+		var param string
+		if strings.HasPrefix(s, "\"") {
+			end := 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' && end+1 < len(s) && s[end+1] == '"' {
+					end++
+				}
+			}
+			if end >= len(s) {
+				return "", nil, NewError(nil, "Unterminated quoted parameter in key: %s", key)
+			}
+
+			param = strings.Replace(s[1:end], "\\\"", "\"", -1)
+			s = strings.TrimLeft(s[end+1:], " ")
+			if s != "" && s[0] != ',' {
+				return "", nil, NewError(nil, "Invalid quoted parameter in key: %s", key)
+			}
+		} else {
+			depth, end := 0, 0
+			for ; end < len(s) && (depth > 0 || s[end] != ','); end++ {
+				switch s[end] {
+				case '[':
+					depth++
+				case ']':
+					depth--
+				}
+			}
+			param, s = s[:end], s[end:]
+		}
+
+		params = append(params, param)
+		if s == "" {
+			return name, params, nil
+		}
+		s = s[1:]
+	}
+}
+
+// ParseKeyAttributes parses whitespace separated 'name=value' attributes as
+// found after a key in a key file. Values may be double quoted.
+func ParseKeyAttributes(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		i := strings.Index(s, "=")
+		if i < 1 {
+			return nil, NewError(nil, "Invalid key attribute: %s", s)
+		}
+
+		name := s[:i]
+		s = s[i+1:]
+
+		var val string
+		if strings.HasPrefix(s, "\"") {
+			end := 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(s) {
+				return nil, NewError(nil, "Unterminated quoted value for key attribute: %s", name)
+			}
+
+			v, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, NewError(err, "Invalid quoted value for key attribute: %s", name)
+			}
+			val, s = v, s[end+1:]
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			val, s = s[:end], s[end:]
+		}
+
+		attrs[name] = val
+	}
+
+	return attrs, nil
+}
+
+// SetAttributes applies attributes parsed from a key file to a key.
+func (c *ItemKey) SetAttributes(attrs map[string]string) error {
+	for name, val := range attrs {
+		switch name {
+		case "weight":
+			weight, err := strconv.ParseFloat(val, 64)
+			if err != nil || weight <= 0 {
+				return NewError(err, "Invalid weight for key %s: %s", c.Key, val)
+			}
+			c.Weight = weight
+
+		case "interval":
+			interval, err := ParseUpdateInterval(val)
+			if err != nil {
+				return NewError(err, "Invalid interval for key %s: %s", c.Key, val)
+			}
+			c.Interval = interval
+
+		case "timeout":
+			timeout, err := ParseDuration(val)
+			if err != nil || timeout <= 0 {
+				return NewError(err, "Invalid timeout for key %s: %s", c.Key, val)
+			}
+			c.Timeout = timeout
+
+		case "value":
+			if val != ValueAny && val != ValueConstant && val != ValueCounter {
+				return NewError(nil, "Invalid value kind for key %s: %s", c.Key, val)
+			}
+			c.Value = val
+
+		case "match":
+			rule, err := ParseMatchRule(val)
+			if err != nil {
+				return NewError(err, "Invalid match rule for key %s: %s", c.Key, val)
+			}
+			c.Match = rule
+
+		default:
+			return NewError(nil, "Unknown attribute for key %s: %s", c.Key, name)
+		}
+	}
+
+	return nil
+}
+
+// inherit copies attributes from an item prototype to a discovered key.
+func (c *ItemKey) inherit(proto *ItemKey) {
+	c.Weight = proto.Weight
+	c.Interval = proto.Interval
+	c.Timeout = proto.Timeout
+	c.Value = proto.Value
+	c.Match = proto.Match
+}
+
+// TimeoutOr returns the timeout of the key if set, otherwise the given default
+// timeout.
+func (c *ItemKey) TimeoutOr(timeout time.Duration) time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+
+	return timeout
+}
+
+// A TimeoutRule sets the timeout of every key matching a regular expression.
+type TimeoutRule struct {
+	Pattern *regexp.Regexp
+	Timeout time.Duration
+}
+
+// ParseTimeoutRule parses a timeout rule in the form 'pattern=timeout' such as
+// 'vfs\.dir\..*=30s'.
+func ParseTimeoutRule(s string) (*TimeoutRule, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return nil, NewError(nil, "Invalid timeout rule: %s", s)
+	}
+
+	pattern, err := regexp.Compile(s[:i])
+	if err != nil {
+		return nil, NewError(err, "Invalid timeout rule pattern: %s", s[:i])
+	}
+
+	timeout, err := ParseDuration(s[i+1:])
+	if err != nil || timeout <= 0 {
+		return nil, NewError(err, "Invalid timeout rule timeout: %s", s[i+1:])
+	}
+
+	return &TimeoutRule{
+		Pattern: pattern,
+		Timeout: timeout,
+	}, nil
+}
+
+// ApplyTimeoutRules sets the timeout of each key which has no timeout of its
+// own to that of the first matching rule.
+func (c ItemKeys) ApplyTimeoutRules(rules []*TimeoutRule) {
+	for _, key := range c {
+		for _, rule := range rules {
+			if key.Timeout == 0 && rule.Pattern.MatchString(key.Key) {
+				dprintf("Setting timeout of key %s to %s\n", key.Key, rule.Timeout)
+				key.Timeout = rule.Timeout
+			}
+		}
+	}
+}
+
+// Rate returns the relative scheduling frequency of a key. Keys with an
+// Interval are weighted by the number of polls per second of their default
+// delay so that a key with an interval of 30s is polled 120 times as often as
+// a key with an interval of 1h.
+func (c *ItemKey) Rate() float64 {
+	if c.Interval != nil && c.Interval.Delay > 0 {
+		return 1 / c.Interval.Delay.Seconds()
+	}
+
+	return c.Weight
+}
+
+// OriginString returns a comma separated list of all origins of a key.
+func (c *ItemKey) OriginString() string {
+	origins := make([]string, len(c.Origins))
+	for i, origin := range c.Origins {
+		origins[i] = origin.String()
+	}
+
+	return strings.Join(origins, ", ")
+}
+
 // LongestKeyName returns the length in characters of the longest key name
 // in an array of keys.
 // Used for formatting output.
@@ -76,6 +399,17 @@ func (c ItemKeys) LongestKeyName() int {
 	return longestKeyName
 }
 
+// Get returns the key with the given name, or nil if it is not in the list.
+func (c ItemKeys) Get(name string) *ItemKey {
+	for _, key := range c {
+		if key.Key == name {
+			return key
+		}
+	}
+
+	return nil
+}
+
 // SortedKeyNames returns the name of all keys in the this key array sorted
 // alphanumerically.
 func (c ItemKeys) SortedKeyNames() []string {
@@ -127,7 +461,7 @@ func (c *ItemKey) Discover(host string, timeout time.Duration) (ItemKeys, error)
 
 	// check if result is unsupported
 	if strings.HasPrefix(val, ZBX_NOTSUPPORTED) {
-		return nil, NewError(nil, "Discovery rule unsupported for item: %s", c.Key)
+		return nil, NewNotSupportedError(c.Key, val)
 	}
 
 	// bind JSON discovery data
@@ -154,6 +488,8 @@ func (c *ItemKey) Discover(host string, timeout time.Duration) (ItemKeys, error)
 			// Item discovered item
 			n := NewItemKey(s)
 			n.IsPrototype = true
+			n.inherit(proto)
+			n.Origins = []KeyOrigin{{Rule: c.Key, Macros: instance}}
 
 			keys = append(keys, n)
 
@@ -165,19 +501,102 @@ func (c *ItemKey) Discover(host string, timeout time.Duration) (ItemKeys, error)
 }
 
 // Expand executes a discovery on all discovery rules in a list of keys and
-// appends the expanded prototypes to the returned array
-func (c ItemKeys) Expand(host string, timeout time.Duration) (ItemKeys, error) {
+// appends the expanded prototypes to the returned array.
+//
+// Discovery is attempted up to retries + 1 times for each rule. Rules which
+// still fail are marked with a DiscoveryError and their prototypes are
+// skipped so that the remaining keys may still be tested. Unsupported rules
+// are not retried.
+func (c ItemKeys) Expand(host string, timeout time.Duration, retries int, retryDelay time.Duration) ItemKeys {
 	keys := c
 	for _, key := range c {
 		if key.IsDiscoveryRule {
-			discoveredKeys, err := key.Discover(host, timeout)
+			var discoveredKeys ItemKeys
+			var err error
+			for i := 0; i <= retries; i++ {
+				if i > 0 {
+					dprintf("Retrying discovery rule in %s: %s\n", retryDelay, key.Key)
+					time.Sleep(retryDelay)
+				}
+
+				discoveredKeys, err = key.Discover(host, timeout)
+				if err == nil || IsNotSupported(err) {
+					break
+				}
+			}
+
 			if err != nil {
-				return nil, NewError(err, "Failed to expand prototypes for discovery rule: %s", key.Key)
+				key.DiscoveryError = NewError(err, "Failed to expand prototypes for discovery rule: %s", key.Key)
+				continue
 			}
 
 			keys = append(keys, discoveredKeys...)
 		}
 	}
 
-	return keys, nil
+	return keys
+}
+
+// Deduplicate returns a list of keys in which each key name appears only once,
+// in the order it first appeared. The origins and prototypes of any duplicates
+// are appended to those of the first key with the same name. The attributes of
+// the first key are kept and an error is returned for each duplicate with
+// different attributes.
+func (c ItemKeys) Deduplicate() (ItemKeys, []error) {
+	keys := ItemKeys{}
+	conflicts := []error{}
+	seen := make(map[string]*ItemKey, len(c))
+	for _, key := range c {
+		if first, ok := seen[key.Key]; ok {
+			dprintf("Removed duplicate key: %s\n", key.Key)
+			if attrs := first.conflicts(key); len(attrs) > 0 {
+				conflicts = append(conflicts, NewError(nil, "Duplicate key %s (%s) has a different %s than at %s; using the first", key.Key, key.OriginString(), strings.Join(attrs, ", "), first.OriginString()))
+			}
+			first.Origins = append(first.Origins, key.Origins...)
+			first.Prototypes = append(first.Prototypes, key.Prototypes...)
+			first.IsDiscoveryRule = first.IsDiscoveryRule || key.IsDiscoveryRule
+			continue
+		}
+
+		seen[key.Key] = key
+		keys = append(keys, key)
+	}
+
+	return keys, conflicts
+}
+
+// conflicts returns the names of the attributes of a duplicate key which
+// differ from those of this key.
+func (c *ItemKey) conflicts(other *ItemKey) []string {
+	attrs := []string{}
+	if c.Weight != other.Weight {
+		attrs = append(attrs, "weight")
+	}
+	if !reflect.DeepEqual(c.Interval, other.Interval) {
+		attrs = append(attrs, "interval")
+	}
+	if c.Timeout != other.Timeout {
+		attrs = append(attrs, "timeout")
+	}
+	if c.Value != other.Value {
+		attrs = append(attrs, "value")
+	}
+	if (c.Match == nil) != (other.Match == nil) || (c.Match != nil && c.Match.Rule != other.Match.Rule) {
+		attrs = append(attrs, "match")
+	}
+
+	return attrs
+}
+
+// DiscoveryFailures returns all discovery rules in a list of keys which failed
+// to expand their prototypes.
+func (c ItemKeys) DiscoveryFailures() ItemKeys {
+	keys := ItemKeys{}
+	for _, key := range c {
+		if key.DiscoveryError != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
 }
@@ -18,8 +18,12 @@ package main
 
 import (
 	"bufio"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 )
 
 type KeyFile struct {
@@ -27,10 +31,97 @@ type KeyFile struct {
 	Keys ItemKeys
 }
 
-var commentPattern = regexp.MustCompile(`^\s*(#.*)?$`)
+var (
+	commentPattern = regexp.MustCompile(`^\s*(#.*)?$`)
+	includePattern = regexp.MustCompile(`^(?i)include(?:\s*=\s*|\s+)(.+?)\s*$`)
+)
+
+// LoadKeyFiles loads Zabbix agent keys from every key file matched by the
+// given paths. Each path may be a file, a directory, in which case every file
+// in the directory is loaded, or a glob pattern.
+func LoadKeyFiles(paths []string) (ItemKeys, error) {
+	keys := ItemKeys{}
+	for _, path := range paths {
+		files, err := ExpandPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(files) == 0 {
+			return nil, NewError(nil, "No key files found matching: %s", path)
+		}
+
+		for _, file := range files {
+			keyfile, err := NewKeyFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			keys = append(keys, keyfile.Keys...)
+		}
+	}
+
+	return keys, nil
+}
+
+// ExpandPath returns the paths of all files matched by the given path in the
+// same manner as the Include parameter of zabbix_agentd.conf. Directories are
+// expanded to all files they contain and glob patterns are expanded to all
+// matching files. Results are sorted alphanumerically.
+func ExpandPath(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		files := []string{}
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+
+		return files, nil
+	}
+
+	// not a glob, let the caller handle missing files
+	if !strings.ContainsAny(path, "*?[") {
+		return []string{path}, nil
+	}
+
+	files, err := filepath.Glob(path)
+	if err != nil {
+		return nil, NewError(err, "Invalid path pattern: %s", path)
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
 
 // NewKeyFile loads Zabbix agent keys from a plain text file
 func NewKeyFile(path string) (*KeyFile, error) {
+	return loadKeyFile(path, nil)
+}
+
+// loadKeyFile loads Zabbix agent keys from a plain text file, including any
+// key files referenced by include directives. parents lists the absolute paths
+// of all files which included this file and is used to detect include cycles.
+func loadKeyFile(path string, parents []string) (*KeyFile, error) {
+
+	// Check for include cycles
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, parent := range parents {
+		if parent == absPath {
+			return nil, NewError(nil, "Key file include cycle detected: %s -> %s", strings.Join(parents, " -> "), absPath)
+		}
+	}
+	parents = append(parents, absPath)
 
 	// Open key file
 	dprintf("Loading keys from file: %s\n", path)
@@ -51,36 +142,86 @@ func NewKeyFile(path string) (*KeyFile, error) {
 	)
 
 	// Read one key per line
+	lineNo := 0
 	buf := bufio.NewScanner(file)
 	for buf.Scan() {
 		line := buf.Text()
+		lineNo++
 
 		// Ignore blanks lines and comments
-		if !commentPattern.MatchString(line) {
-			newKey := NewItemKey(line)
-
-			// is this a child prototype item?
-			if indentPattern.MatchString(line) {
-				dprintf("Added key prototype: %s\n", newKey.Key)
-
-				// Make the parent a Discovery Rule if not already
-				newKey.IsPrototype = true
-				if parentKey == nil {
-					parentKey = lastKey
-					parentKey.IsDiscoveryRule = true
+		if commentPattern.MatchString(line) {
+			continue
+		}
+
+		// Load included key files relative to this file
+		if m := includePattern.FindStringSubmatch(line); m != nil {
+			include := m[1]
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(path), include)
+			}
+
+			files, err := ExpandPath(include)
+			if err != nil {
+				return nil, NewError(err, "Failed to include key files at %s:%d", path, lineNo)
+			}
+
+			for _, f := range files {
+				dprintf("Including key file: %s\n", f)
+				included, err := loadKeyFile(f, parents)
+				if err != nil {
+					return nil, NewError(err, "Failed to include key file at %s:%d", path, lineNo)
 				}
 
-				// Append to parent
-				parentKey.Prototypes = append(parentKey.Prototypes, newKey)
-			} else {
-				// This is a normal key
-				dprintf("Added key: %s\n", newKey.Key)
-				parentKey = nil
-				keyfile.Keys = append(keyfile.Keys, newKey)
+				keyfile.Keys = append(keyfile.Keys, included.Keys...)
 			}
 
-			lastKey = newKey
+			// prototypes may not follow an include
+			parentKey = nil
+			lastKey = nil
+			continue
 		}
+
+		keyText, attrText := SplitKeyLine(line)
+		newKey := NewItemKey(keyText)
+		newKey.Origins = []KeyOrigin{{File: path, Line: lineNo}}
+
+		attrs, err := ParseKeyAttributes(ParseItemKey(attrText))
+		if err == nil {
+			err = newKey.SetAttributes(attrs)
+		}
+		if err != nil {
+			return nil, NewError(err, "Invalid key at %s:%d", path, lineNo)
+		}
+
+		// is this a child prototype item?
+		if indentPattern.MatchString(line) {
+			if lastKey == nil {
+				return nil, NewError(nil, "Item prototype has no discovery rule at %s:%d", path, lineNo)
+			}
+
+			dprintf("Added key prototype: %s\n", newKey.Key)
+
+			// Make the parent a Discovery Rule if not already
+			newKey.IsPrototype = true
+			if parentKey == nil {
+				parentKey = lastKey
+				parentKey.IsDiscoveryRule = true
+			}
+
+			// Append to parent
+			parentKey.Prototypes = append(parentKey.Prototypes, newKey)
+		} else {
+			// This is a normal key
+			dprintf("Added key: %s\n", newKey.Key)
+			parentKey = nil
+			keyfile.Keys = append(keyfile.Keys, newKey)
+		}
+
+		lastKey = newKey
+	}
+
+	if err := buf.Err(); err != nil {
+		return nil, NewError(err, "Failed to read key file: %s", path)
 	}
 
 	dprintf("Finished loading key file\n")
@@ -20,10 +20,12 @@ import (
 	"flag"
 	"fmt"
 	"github.com/mitchellh/colorstring"
+	"math/rand"
 	"os"
 	"os/signal"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,16 +39,64 @@ const (
 
 // command args
 var (
+	agentConfPath  string
+	agentTimeout   int
 	debug          bool
+	intervalArg    string
+	jitterMsArg    int
+	lateMsArg      int
+	metricsListen  string
+	influxDest     string
+	graphiteDest   string
+	graphitePrefix string
+	reportFormat   string
+	reportPath     string
+	baselinePath   string
+	discoRetries   int
+	discoDelayArg  int
 	exitErrorCount bool
 	host           string
+	hostB          string
 	iterationLimit int
+	isolate        bool
+	bisect         bool
+	restartCmd     string
+	restartWait    int
+	hookBefore     string
+	hookStage      string
+	hookFirstError string
+	hookAfter      string
+	hookTimeout    int
 	key            string
-	keyFilePath    string
+	keyFilePaths   StringList
 	port           int
+	progressArg    int
+	retries        int
+	retryBackoff   int
+	retryMaxArg    int
+	retryOn        string
+	unreachErrors  int
+	unreachPeriod  int
+	unreachDelay   int
+	unavailDelay   int
+	schedule       string
 	delayMsArg     int
 	staggerMsArg   int
 	threadCount    int
+	timeoutRules   StringList
+	timeoutWarn    float64
+	trackValues    bool
+	snapshotMode   string
+	snapshotPath   string
+	agentPID       int
+	agentPIDFile   string
+	agentSampleArg int
+	agentLogPath   string
+	direct         bool
+	seriesPath     string
+	seriesFormat   string
+	seriesInterval int
+	tui            bool
 	timeLimitArg   int
 	timeoutMsArg   int
 	verbose        bool
@@ -56,26 +106,119 @@ var (
 var (
 	timeout       time.Duration
 	delayDuration time.Duration
+	lateThreshold time.Duration
+	retryPolicy   *RetryPolicy
+	availability  *Availability
+	abTest        *ABTest
+	directTest    *DirectTest
+	valueTracker  *ValueTracker
+	snapshot      *Snapshot
+	hooks         *Hooks
+	monitor       = NewMonitor()
 )
 
 // flag to signal all threads to stop gracefully
 var stop = false
 
+// flag to signal producers to pause. It must only be accessed with isPaused
+// and togglePaused.
+var paused int32
+
+// isPaused returns true if producers have been paused from the dashboard.
+func isPaused() bool {
+	return atomic.LoadInt32(&paused) != 0
+}
+
+// togglePaused pauses or resumes producers.
+func togglePaused() {
+	for {
+		old := atomic.LoadInt32(&paused)
+		if atomic.CompareAndSwapInt32(&paused, old, 1-old) {
+			return
+		}
+	}
+}
+
 func main() {
 
+	// Run sub commands
+	if len(os.Args) > 1 && os.Args[1] == "userparams" {
+		UserParamsCommand(os.Args[2:])
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		CompareCommand(os.Args[2:])
+		os.Exit(0)
+	}
+
 	// Configure from command line
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", APP)
+		fmt.Fprintf(os.Stderr, "       %s userparams [options] <zabbix_agentd.conf>\n", APP)
+		fmt.Fprintf(os.Stderr, "       %s compare [options] <baseline.json> <results.json>\n\n", APP)
+		flag.PrintDefaults()
+	}
 	flag.BoolVar(&version, "version", false, "print version")
 	flag.StringVar(&host, "host", "localhost", "remote Zabbix agent host")
+	flag.BoolVar(&direct, "direct", false, "also run the commands of UserParameters in -agent-config directly to measure the overhead of the agent")
+	flag.StringVar(&hostB, "host-b", "", "compare the results of a second agent host, checked alongside -host")
 	flag.IntVar(&port, "port", 10050, "remote Zabbix agent TCP port")
 	flag.IntVar(&timeoutMsArg, "timeout", 3000, "timeout in milliseconds for each zabbix_get request")
+	flag.Var(&timeoutRules, "timeout-rule", "set the timeout of keys matching a regular expression as 'pattern=timeout' (may be repeated)")
+	flag.IntVar(&agentPID, "agent-pid", 0, "monitor the resources used by the local agent process with this PID")
+	flag.StringVar(&agentPIDFile, "agent-pidfile", "", "monitor the resources used by the local agent process in this PID file")
+	flag.IntVar(&agentSampleArg, "agent-sample", 5, "interval in seconds between samples of the agent process")
+	flag.StringVar(&agentLogPath, "agent-log", "", "follow the local agent log file and show the lines of failed or slow keys")
+	flag.StringVar(&agentConfPath, "agent-config", "", "read settings such as Timeout from a zabbix_agentd.conf file")
+	flag.IntVar(&agentTimeout, "agent-timeout", 0, "Timeout setting of the agent in seconds (default from -agent-config or 3)")
+	flag.Float64Var(&timeoutWarn, "timeout-warn", 0.8, "warn about keys with a 95th percentile latency above this fraction of the agent timeout")
 	flag.IntVar(&delayMsArg, "delay", 0, "delay between queries on each thread in milliseconds")
 	flag.IntVar(&staggerMsArg, "offset", 0, "delay start of each thread in milliseconds")
 	flag.IntVar(&threadCount, "threads", runtime.NumCPU(), "number of test threads")
 	flag.IntVar(&timeLimitArg, "timelimit", 0, "time limit in seconds")
 	flag.IntVar(&iterationLimit, "iterations", 0, "maximum test iterations of each key")
-	flag.StringVar(&keyFilePath, "keys", "", "read keys from file path")
+	flag.BoolVar(&bisect, "bisect", false, "search for the smallest set of keys which crashes or hangs the agent")
+	flag.StringVar(&restartCmd, "restart-cmd", "", "shell command to restart the agent after it went down while bisecting")
+	flag.IntVar(&restartWait, "restart-wait", 60, "seconds to wait for the agent to come back after it went down while bisecting")
+	flag.BoolVar(&isolate, "isolate", false, "check each key or discovery rule on its own and rank them by growth of the agent process resources")
+	flag.StringVar(&reportFormat, "report", "", "write a report of the run in this format: html or json")
+	flag.StringVar(&baselinePath, "baseline", "", "compare results with a baseline saved with '-report json'")
+	addThresholdFlags(flag.CommandLine)
+	flag.StringVar(&reportPath, "report-file", "", "path of the report file (default zabbix_agent_bench.<format>)")
+	flag.StringVar(&schedule, "schedule", ScheduleSequential, "key schedule: sequential, weighted, random or poller")
+	flag.StringVar(&intervalArg, "interval", "1m", "default update interval of keys in the poller schedule")
+	flag.IntVar(&jitterMsArg, "jitter", 0, "maximum random delay added to each check in the poller schedule in milliseconds")
+	flag.IntVar(&lateMsArg, "late", 5000, "queue delay in milliseconds after which a check is late in the poller schedule")
+	flag.StringVar(&metricsListen, "metrics-listen", "", "serve Prometheus metrics at /metrics on this address during the run (e.g. ':9105')")
+	flag.StringVar(&hookBefore, "hook-before", "", "shell command to run before the run, such as to start the agent")
+	flag.StringVar(&hookStage, "hook-stage", "", "shell command to run before each stage of the run, given as $BENCH_STAGE")
+	flag.StringVar(&hookFirstError, "hook-first-error", "", "shell command to run after the first transport error, given as $BENCH_KEY and $BENCH_ERROR")
+	flag.StringVar(&hookAfter, "hook-after", "", "shell command to run after the run, such as to collect the agent log")
+	flag.IntVar(&hookTimeout, "hook-timeout", 300, "seconds after which a hook command is killed (0 to disable)")
+	flag.Var(&keyFilePaths, "keys", "read keys from file, directory or glob (may be repeated)")
 	flag.StringVar(&key, "key", "", "benchmark a single agent item key")
+	flag.IntVar(&retries, "retries", 0, "retry failed requests this many times")
+	flag.IntVar(&retryBackoff, "retry-backoff", 100, "initial delay between retries in milliseconds, doubled after each retry")
+	flag.IntVar(&retryMaxArg, "retry-max-backoff", 5000, "maximum delay between retries in milliseconds")
+	flag.StringVar(&retryOn, "retry-on", "refused,reset,eof", "retryable error classes: refused, reset, timeout, eof, other or all")
+	flag.IntVar(&unreachErrors, "unreachable-errors", 0, "consecutive errors after which the agent is unreachable (default disabled)")
+	flag.IntVar(&unreachPeriod, "unreachable-period", 45, "seconds after which an unreachable agent is unavailable")
+	flag.IntVar(&unreachDelay, "unreachable-delay", 15, "seconds between probes of an unreachable agent")
+	flag.IntVar(&unavailDelay, "unavailable-delay", 60, "seconds between probes of an unavailable agent")
+	flag.IntVar(&discoRetries, "discovery-retries", 0, "retry failed discovery rules this many times")
+	flag.IntVar(&discoDelayArg, "discovery-delay", 1000, "delay between discovery retries in milliseconds")
 	flag.BoolVar(&exitErrorCount, "strict", false, "exit code to include tally of unsupported items")
+	flag.IntVar(&progressArg, "progress", 10, "print a status line every this many seconds (0 to disable)")
+	flag.StringVar(&seriesPath, "timeseries", "", "write per interval stats of the run to a file")
+	flag.StringVar(&seriesFormat, "timeseries-format", "", "time series format: csv or jsonl (default from file extension)")
+	flag.IntVar(&seriesInterval, "timeseries-interval", 1, "interval in seconds of time series and exported metrics")
+	flag.StringVar(&influxDest, "influx", "", "write metrics in InfluxDB line protocol to a file, 'tcp://host:port' or 'udp://host:port'")
+	flag.StringVar(&graphiteDest, "graphite", "", "write metrics in Graphite plaintext protocol to a file, 'tcp://host:port' or 'udp://host:port'")
+	flag.StringVar(&graphitePrefix, "graphite-prefix", APP, "prefix of Graphite metric names")
+	flag.StringVar(&snapshotMode, "snapshot", "", "record the response of each key to a snapshot file or verify responses against it: record or verify")
+	flag.StringVar(&snapshotPath, "snapshot-file", APP+".snapshot.json", "path of the snapshot file")
+	flag.BoolVar(&trackValues, "track-values", false, "check values of each key for inconsistencies across iterations")
+	flag.BoolVar(&tui, "tui", false, "show a live dashboard instead of progress output if stdout is a terminal")
 	flag.BoolVar(&verbose, "verbose", false, "print more output")
 	flag.BoolVar(&debug, "debug", false, "print program debug messages")
 	flag.Parse()
@@ -84,6 +227,7 @@ func main() {
 	stagger := time.Duration(staggerMsArg) * time.Millisecond
 	delayDuration = time.Duration(delayMsArg) * time.Millisecond
 	timeLimit := time.Duration(timeLimitArg) * time.Second
+	lateThreshold = time.Duration(lateMsArg) * time.Millisecond
 
 	// print version and exit
 	if version {
@@ -91,40 +235,159 @@ func main() {
 		os.Exit(0)
 	}
 
+	if seriesInterval < 1 {
+		fmt.Fprintf(os.Stderr, "-timeseries-interval must be at least 1 second\n")
+		os.Exit(1)
+	}
+	if agentSampleArg < 1 {
+		fmt.Fprintf(os.Stderr, "-agent-sample must be at least 1 second\n")
+		os.Exit(1)
+	}
+	if bisect && isolate {
+		fmt.Fprintf(os.Stderr, "-bisect and -isolate may not be used together\n")
+		os.Exit(1)
+	}
+
+	// configure lifecycle hooks
+	hooks = &Hooks{
+		Before:     hookBefore,
+		Stage:      hookStage,
+		FirstError: hookFirstError,
+		After:      hookAfter,
+		Timeout:    time.Duration(hookTimeout) * time.Second,
+	}
+
+	// compare a second agent
+	if hostB != "" {
+		abTest = NewABTest(host, hostB)
+	}
+
+	// track values
+	if trackValues {
+		valueTracker = NewValueTracker()
+	}
+
+	// record or verify responses
+	if snapshotMode != "" {
+		var err error
+		snapshot, err = NewSnapshot(snapshotMode, snapshotPath)
+		PanicOn(err, "Failed to load snapshot")
+	}
+
+	// load baseline results before testing
+	var baseline *RunReport
+	if baselinePath != "" {
+		var err error
+		baseline, err = LoadRunReport(baselinePath)
+		PanicOn(err, "Failed to load baseline")
+		thresholds.MinLatencyIncrease = time.Duration(minLatencyMsArg) * time.Millisecond
+	}
+
+	// configure retries
+	if retries > 0 {
+		var err error
+		retryPolicy, err = NewRetryPolicy(retries, time.Duration(retryBackoff)*time.Millisecond, time.Duration(retryMaxArg)*time.Millisecond, retryOn)
+		PanicOn(err, "Invalid retry policy")
+	}
+
+	// track agent availability
+	if unreachErrors > 0 {
+		availability = &Availability{
+			ErrorLimit:        unreachErrors,
+			UnreachablePeriod: time.Duration(unreachPeriod) * time.Second,
+			UnreachableDelay:  time.Duration(unreachDelay) * time.Second,
+			UnavailableDelay:  time.Duration(unavailDelay) * time.Second,
+		}
+	}
+
+	// find the agent's own timeout
+	agentTimeoutDuration := AgentDefaultTimeout
+	var agentConfig *AgentConfig
+	if agentConfPath != "" {
+		var err error
+		agentConfig, err = LoadAgentConfig(agentConfPath)
+		PanicOn(err, "Failed to load agent config")
+		agentTimeoutDuration = agentConfig.Timeout
+	}
+	if agentTimeout > 0 {
+		agentTimeoutDuration = time.Duration(agentTimeout) * time.Second
+	}
+
+	// run UserParameter commands directly
+	if direct {
+		if agentConfig == nil {
+			fmt.Fprintf(os.Stderr, "Running UserParameters directly requires -agent-config\n")
+			os.Exit(1)
+		}
+		if !IsLocalHost(host) {
+			fmt.Fprintf(os.Stderr, "Running UserParameters directly requires -host to be an address of this host, not %s\n", host)
+			os.Exit(1)
+		}
+		directTest = NewDirectTest(agentConfig)
+	}
+
 	// Bind threads to each core
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	// prepare the agent
+	PanicOn(hooks.RunBefore(), "Before hook failed")
+
 	// Create a list of keys for processing
 	queuedKeys := ItemKeys{}
 
 	// user specified a single key
 	if key != "" {
-		queuedKeys = append(queuedKeys, NewItemKey(key))
+		newKey := NewItemKey(key)
+		newKey.Origins = []KeyOrigin{{}}
+		queuedKeys = append(queuedKeys, newKey)
 	}
 
-	// load item keys from text file
-	if keyFilePath != "" {
-		keyFile, err := NewKeyFile(keyFilePath)
+	// load item keys from text files
+	if len(keyFilePaths) > 0 {
+		keys, err := LoadKeyFiles(keyFilePaths)
 		PanicOn(err, "Failed to open key file")
+		queuedKeys = append(queuedKeys, keys...)
+	}
+
+	// remove duplicate keys so each discovery rule is executed once
+	keyCount := len(queuedKeys)
+	queuedKeys = deduplicateKeys(queuedKeys)
+	duplicateCount := keyCount - len(queuedKeys)
+
+	// expand discovery item prototypes by doing an actual agent discovery
+	queuedKeys = queuedKeys.Expand(host, timeout, discoRetries, time.Duration(discoDelayArg)*time.Millisecond)
 
-		// expand discovery item prototypes by doing an actual agent discovery
-		queuedKeys, err = keyFile.Keys.Expand(host, timeout)
-		PanicOn(err, "Failed to expand discovery items")
+	// report discovery rules which failed but carry on with the other keys
+	discoveryFailures := queuedKeys.DiscoveryFailures()
+	for _, key := range discoveryFailures {
+		PrintWarning(key.DiscoveryError)
 	}
 
 	// Make sure we have work to do
 	if 0 == len(queuedKeys) {
 		fmt.Fprintf(os.Stderr, "No agent item keys specified for testing\n")
-		os.Exit(1)
+		hooks.Exit(1)
 	}
 
-	// TODO: deduplicate the key list
+	// remove duplicate keys created by discovery so each is tested and
+	// reported once
+	keyCount = len(queuedKeys)
+	queuedKeys = deduplicateKeys(queuedKeys)
+	duplicateCount += keyCount - len(queuedKeys)
 
-	// start producer thread
-	fmt.Printf("Testing %d keys with %d threads (press Ctrl-C to cancel)...\n", len(queuedKeys), threadCount)
-	HandleSignals()
-	statsChan := make(chan *ThreadStats)
-	producer := StartProducer(queuedKeys, statsChan)
+	// apply per key timeouts
+	rules := []*TimeoutRule{}
+	for _, s := range timeoutRules {
+		rule, err := ParseTimeoutRule(s)
+		PanicOn(err, "Invalid timeout rule")
+		rules = append(rules, rule)
+	}
+	queuedKeys.ApplyTimeoutRules(rules)
+	if verbose {
+		for _, key := range queuedKeys {
+			fmt.Printf("Queued key: %s (%s)\n", key.Key, key.OriginString())
+		}
+	}
 
 	// set time limit if set
 	if 0 < timeLimit {
@@ -134,40 +397,273 @@ func main() {
 			stop = true
 		}()
 	}
+
+	// search for the keys which take the agent down
+	if bisect {
+		BisectCommand(queuedKeys)
+	}
+
+	// check each key on its own to find which leaks agent resources
+	if isolate {
+		IsolateCommand(queuedKeys)
+	}
+
+	hooks.RunStage("benchmark")
+
+	// start producer thread
+	fmt.Printf("Testing %d keys with %d threads (press Ctrl-C to cancel)...\n", len(queuedKeys), threadCount)
+	HandleSignals()
+	statsChan := make(chan *ThreadStats)
+	var producer <-chan *Check
+	if schedule == SchedulePoller {
+		defaultInterval, err := ParseUpdateInterval(intervalArg)
+		PanicOn(err, "Invalid default update interval")
+		producer = StartPoller(queuedKeys, defaultInterval, time.Duration(jitterMsArg)*time.Millisecond, statsChan)
+	} else {
+		scheduler, err := NewScheduler(schedule, queuedKeys)
+		PanicOn(err, "Failed to create key scheduler")
+		producer = StartProducer(queuedKeys, scheduler, statsChan)
+	}
+
+	// monitor the local agent process
+	var procMonitor *ProcessMonitor
+	if agentPID > 0 || agentPIDFile != "" {
+		procMonitor = NewProcessMonitor(agentPID, agentPIDFile, time.Duration(agentSampleArg)*time.Second)
+		PanicOn(procMonitor.Start(), "Failed to monitor agent process")
+	}
+
+	// follow the agent log
+	var agentLog *AgentLog
+	if agentLogPath != "" {
+		agentLog = NewAgentLog(agentLogPath, queuedKeys)
+		PanicOn(agentLog.Start(), "Failed to follow agent log")
+	}
+
 	start := time.Now()
+	monitor.Start()
+	pool := NewConsumerPool(producer, statsChan)
+
+	// start the dashboard, falling back to plain output if not a terminal
+	var dashboard *Dashboard
+	if tui {
+		errorFeed = NewErrorFeed(100)
+		var err error
+		if dashboard, err = NewDashboard(queuedKeys, pool, monitor, timeLimit); err != nil {
+			PrintWarning(NewError(err, "Using plain output"))
+		} else {
+			verbose = false
+			dashboard.Start()
+		}
+	}
+
+	// serve metrics
+	if metricsListen != "" {
+		PanicOn(StartMetricsServer(metricsListen, monitor, pool), "Failed to start metrics server")
+	}
+
+	// record time series and export metrics
+	sampler := NewSampler(monitor, time.Duration(seriesInterval)*time.Second)
+	if seriesPath != "" {
+		w, err := NewTimeSeriesFile(seriesPath, TimeSeriesFormat(seriesPath, seriesFormat))
+		PanicOn(err, "Failed to create time series file")
+		sampler.AddWriter(w)
+	}
+	if influxDest != "" {
+		w, err := NewInfluxWriter(influxDest, host)
+		PanicOn(err, "Failed to start InfluxDB exporter")
+		sampler.AddWriter(w)
+	}
+	if graphiteDest != "" {
+		w, err := NewGraphiteWriter(graphiteDest, graphitePrefix, host)
+		PanicOn(err, "Failed to start Graphite exporter")
+		sampler.AddWriter(w)
+	}
+	history := &SampleHistory{}
+	if reportFormat != "" {
+		sampler.AddWriter(history)
+	}
+	sampler.Start()
+
+	if progressArg > 0 && dashboard == nil {
+		expected := int64(0)
+		if iterationLimit > 0 {
+			expected = int64(iterationLimit * len(queuedKeys))
+		}
+		StartProgress(monitor, time.Duration(progressArg)*time.Second, timeLimit, expected)
+	}
 
 	// fan out consumer threads to start work
 	for i := 0; !stop && i < threadCount; i++ {
 		// Stagger thread start
 		time.Sleep(stagger)
-
-		dprintf("Starting thread %d...\n", i+1)
-		go StartConsumer(producer, statsChan)
+		pool.Resize(i + 1)
 	}
 
 	// Fan in threads to gather stats
 	totals := NewThreadStats()
-	for i := 0; i < threadCount+1; i++ {
+	for i := 0; i < pool.Started()+1; i++ {
 		threadStats := <-statsChan
 		totals.Add(threadStats)
 	}
 
 	duration := time.Now().Sub(start)
 
+	// stop any remaining goroutines such as progress reporting
+	stop = true
+	if dashboard != nil {
+		dashboard.Close()
+	}
+	sampler.Stop()
+	if agentLog != nil {
+		agentLog.Stop()
+	}
+	if procMonitor != nil {
+		procMonitor.Stop()
+	}
+	hooks.RunAfter()
+
 	// Sort the key list
 	keyNames := queuedKeys.SortedKeyNames()
 
+	// Build the run report
+	report := &RunReport{
+		Version:           APP_VERSION,
+		CommandLine:       strings.Join(os.Args, " "),
+		Settings:          ReportSettings(),
+		Host:              host,
+		Start:             start,
+		Duration:          duration,
+		Threads:           pool.Size(),
+		Totals:            totals,
+		Keys:              make([]*KeyReport, 0, len(keyNames)),
+		History:           history.Points(),
+		DiscoveryFailures: make([]string, 0, len(discoveryFailures)),
+	}
+	for _, key := range discoveryFailures {
+		report.DiscoveryFailures = append(report.DiscoveryFailures, key.DiscoveryError.Error())
+	}
+	if availability != nil {
+		report.Outages = availability.Outages()
+	}
+	if procMonitor != nil {
+		report.Resources = procMonitor.Trends()
+		report.AgentRestarts = procMonitor.Restarts()
+	}
+	report.Hooks = hooks.Results()
+
 	// Print results per key
 	longestKeyName := queuedKeys.LongestKeyName()
 	for _, key := range keyNames {
 		keyStats := totals.KeyStats[key]
-
-		// escape %'s in key name
-		key = strings.Replace(key, "%", "%%", -1)
+		origins := queuedKeys.Get(key).OriginString()
 
 		// show stats
-		row := fmt.Sprintf("%-*s :\t%s\t%s\t%s\n", longestKeyName, key, hl(keyStats.Success, "green"), hl(keyStats.NotSupported, "yellow"), hl(keyStats.Error, "red"))
-		colorstring.Printf(row)
+		rate := float64(keyStats.Polls()) / duration.Seconds()
+		row := fmt.Sprintf("%-*s :\t%s\t%s\t%s\t%.3f/s\t%s\n", longestKeyName, key, hl(keyStats.Success, "green"), hl(keyStats.NotSupported, "yellow"), hl(keyStats.Error, "red"), rate, formatLatency(keyStats.Latency.Percentile(95)))
+		fmt.Print(row)
+
+		if verbose {
+			fmt.Printf("%-*s    from %s\n", longestKeyName, "", origins)
+		}
+	}
+
+	// Print poller schedule results per key
+	if schedule == SchedulePoller {
+		fmt.Printf("\n=== Poller schedule ===\n\n")
+		fmt.Printf("%-*s  \tpolls\tlate\tmissed\tavg delay\tmax delay\n", longestKeyName, "key")
+		for _, key := range keyNames {
+			keyStats := totals.KeyStats[key]
+			avgDelay := time.Duration(0)
+			if keyStats.Polls() > 0 {
+				avgDelay = keyStats.QueueDelay / time.Duration(keyStats.Polls())
+			}
+
+			row := fmt.Sprintf("%-*s :\t%d\t%s\t%s\t%s\t%s\n", longestKeyName, key, keyStats.Polls(), hl(keyStats.Late, "yellow"), hl(keyStats.Missed, "red"), avgDelay, keyStats.MaxQueueDelay)
+			fmt.Print(row)
+		}
+	}
+
+	// Print keys which needed retries
+	if retryPolicy != nil && totals.RetryCount > 0 {
+		fmt.Printf("\n=== Retried keys ===\n\n")
+		fmt.Printf("%-*s  \tretries\tfirst try\teventual\n", longestKeyName, "key")
+		for _, key := range keyNames {
+			keyStats := totals.KeyStats[key]
+			if keyStats.Retries > 0 {
+				fmt.Printf("%-*s :\t%d\t%.2f%%\t\t%.2f%%\n", longestKeyName, key, keyStats.Retries, percent(keyStats.FirstTry, keyStats.Polls()), percent(keyStats.Responses(), keyStats.Polls()))
+			}
+		}
+	}
+
+	// Print keys with a latency close to their timeout
+	atRisk := []string{}
+	for _, name := range keyNames {
+		keyReport := NewKeyReport(queuedKeys.Get(name), totals.KeyStats[name], agentTimeoutDuration, timeoutWarn)
+		report.Keys = append(report.Keys, keyReport)
+
+		if keyReport.AtRisk {
+			atRisk = append(atRisk, fmt.Sprintf("%-*s :\tp95 %s\ttimeout %s", longestKeyName, name, formatLatency(keyReport.Stats.Latency.Percentile(95)), keyReport.Timeout))
+		}
+
+		if directTest != nil {
+			if stats := directTest.Get(name); stats.Pairs > 0 {
+				keyReport.Direct = &stats
+			}
+		}
+
+		// attach the agent log of keys which failed or were slow
+		if agentLog != nil && (keyReport.AtRisk || keyReport.Stats.NotSupported > 0 || keyReport.Stats.Error > 0) {
+			keyReport.Log = agentLog.Lines(name)
+		}
+	}
+
+	if len(atRisk) > 0 {
+		colorstring.Printf("\n[yellow]=== Keys at risk of timing out ===[default]\n\n")
+		for _, row := range atRisk {
+			fmt.Println(row)
+		}
+	}
+
+	// Print agent log lines of failed or slow keys
+	if agentLog != nil {
+		PrintAgentLog(report.Keys)
+	}
+
+	// Print value anomalies
+	anomalies := 0
+	if valueTracker != nil {
+		anomalies = valueTracker.Print(keyNames)
+	}
+
+	// Print snapshot results
+	snapshotFailures := 0
+	if snapshot != nil {
+		if snapshot.Mode == SnapshotRecord {
+			if err := snapshot.Save(); err != nil {
+				PrintError(err)
+			}
+		}
+		snapshotFailures = snapshot.Print(keyNames)
+	}
+
+	// Print agent resource usage
+	leaks := 0
+	if procMonitor != nil {
+		leaks = procMonitor.Print()
+	}
+
+	// Print hook results
+	failedHooks := hooks.Print()
+
+	// Print A/B comparison
+	if abTest != nil {
+		abTest.Print(keyNames, longestKeyName)
+	}
+
+	// Print UserParameter overhead
+	directKeys := 0
+	if directTest != nil {
+		directKeys = directTest.Print(keyNames, longestKeyName)
 	}
 
 	// Print totals
@@ -176,15 +672,121 @@ func main() {
 	fmt.Printf("Total unsupported values:\t%d\n", totals.UnsupportedValues)
 	fmt.Printf("Total transport errors:\t\t%d\n", totals.ErrorCount)
 	fmt.Printf("Total key list iterations:\t%d\n", totals.Iterations)
+	if retryPolicy != nil {
+		polls := totals.TotalValues + totals.ErrorCount
+		fmt.Printf("Total retries:\t\t\t%d\n", totals.RetryCount)
+		fmt.Printf("First try success rate:\t\t%.2f%%\n", percent(totals.FirstTryCount, polls))
+		fmt.Printf("Eventual success rate:\t\t%.2f%%\n", percent(totals.TotalValues, polls))
+	}
+	fmt.Printf("Total keys at risk of timeout:\t%d\n", len(atRisk))
+	if valueTracker != nil {
+		fmt.Printf("Total keys with anomalies:\t%d\n", anomalies)
+	}
+	if snapshot != nil && snapshot.Mode == SnapshotVerify {
+		fmt.Printf("Total snapshot mismatches:\t%d\n", snapshotFailures)
+	}
+	if abTest != nil {
+		fmt.Printf("Total keys with A/B type diffs:\t%d\n", abTest.TypeDiffKeys())
+	}
+	if directTest != nil {
+		fmt.Printf("Total UserParameters run directly:\t%d\n", directKeys)
+	}
+	if procMonitor != nil {
+		fmt.Printf("Total suspected resource leaks:\t%d\n", leaks)
+	}
+	if agentLog != nil {
+		fmt.Printf("Total agent log lines:\t\t%d\n", agentLog.Count())
+	}
+	if len(hooks.Results()) > 0 {
+		fmt.Printf("Total failed hooks:\t\t%d\n", failedHooks)
+	}
+	if availability != nil {
+		fmt.Printf("Total agent outages:\t\t%d\n", len(availability.Outages()))
+	}
+	if schedule == SchedulePoller {
+		fmt.Printf("Total late polls:\t\t%d\n", totals.LateCount)
+		fmt.Printf("Total missed polls:\t\t%d\n", totals.MissedCount)
+	}
+	fmt.Printf("Total duplicate keys removed:\t%d\n", duplicateCount)
+	fmt.Printf("Total failed discovery rules:\t%d\n", len(discoveryFailures))
+
+	// Print failed discovery rules
+	if len(discoveryFailures) > 0 {
+		fmt.Printf("\n=== Failed discovery rules ===\n\n")
+		for _, key := range discoveryFailures {
+			fmt.Printf("%s\n", key.DiscoveryError)
+		}
+	}
 
-	colorstring.Printf("\n[green]Finished![default] Processed %d values across %d threads in %s (%f NVPS)\n", totals.TotalValues, threadCount, duration.String(), (float64(totals.TotalValues) / duration.Seconds()))
+	// Print agent outages
+	if availability != nil {
+		outages := availability.Outages()
+		if len(outages) > 0 {
+			fmt.Printf("\n=== Agent outages ===\n\n")
+			for _, outage := range outages {
+				end := "end of run"
+				if !outage.End.IsZero() {
+					end = outage.End.Format("15:04:05")
+				}
+				colorstring.Printf("[red]Agent was down for %s at %s[default] (until %s, %d errors, %d probes)\n", outage.Duration()/time.Millisecond*time.Millisecond, outage.Start.Format("15:04:05"), end, outage.Errors, outage.Probes)
+			}
+		}
+	}
+
+	// Write the report file
+	if reportFormat != "" {
+		path := ReportPath(reportPath, reportFormat)
+		if err := report.WriteReport(path, reportFormat); err != nil {
+			PrintError(err)
+		} else {
+			fmt.Printf("\nReport written to %s\n", path)
+		}
+	}
+
+	// Compare with baseline
+	regressed := false
+	if baseline != nil {
+		fmt.Printf("\n=== Baseline comparison ===\n\n")
+		comparison := Compare(baseline, report, thresholds)
+		comparison.Print()
+		regressed = comparison.Regressed()
+	}
+
+	colorstring.Printf("\n[green]Finished![default] Processed %d values across %d threads in %s (%f NVPS)\n", totals.TotalValues, pool.Size(), duration.String(), (float64(totals.TotalValues) / duration.Seconds()))
 
 	// exit code
+	exitCode := int(totals.ErrorCount)
 	if exitErrorCount {
-		os.Exit(int(totals.UnsupportedValues + totals.ErrorCount))
-	} else {
-		os.Exit(int(totals.ErrorCount))
+		exitCode = int(totals.UnsupportedValues + totals.ErrorCount)
 	}
+	if (regressed || snapshotFailures > 0) && exitCode == 0 {
+		exitCode = 1
+	}
+	os.Exit(exitCode)
+}
+
+// deduplicateKeys removes duplicate keys and prints a warning for each
+// duplicate with attributes which differ from the first.
+func deduplicateKeys(keys ItemKeys) ItemKeys {
+	keys, conflicts := keys.Deduplicate()
+	for _, err := range conflicts {
+		PrintWarning(err)
+	}
+
+	return keys
+}
+
+// StringList is a flag.Value which collects the values of a repeated command
+// line flag.
+type StringList []string
+
+func (c *StringList) String() string {
+	return strings.Join(*c, ", ")
+}
+
+func (c *StringList) Set(value string) error {
+	*c = append(*c, value)
+	return nil
 }
 
 // HandleSignals starts a new goroutine to handle signals from the operating
@@ -208,72 +810,164 @@ func HandleSignals() {
 	}()
 }
 
-// StartProducer starts a goroutine which iterates through the list of queued
-// agent item check keys and published them sequentially to the returned
-// channel until the runtime limits are reached.
-func StartProducer(keys ItemKeys, statsChan chan *ThreadStats) <-chan *ItemKey {
-	c := make(chan *ItemKey)
+// StartProducer starts a goroutine which publishes agent item check keys from
+// the given scheduler to the returned channel until the runtime limits are
+// reached. Each iteration publishes as many keys as there are in the queued
+// key list.
+func StartProducer(keys ItemKeys, next Scheduler, statsChan chan *ThreadStats) <-chan *Check {
+	c := make(chan *Check)
 	go func() {
-		stats := ThreadStats{}
+		stats := NewThreadStats()
+		monitor.Register(stats)
 		for i := 0; !stop && (iterationLimit <= 0 || i < iterationLimit); i++ {
-			for _, key := range keys {
+			for range keys {
+				for isPaused() && !stop {
+					time.Sleep(100 * time.Millisecond)
+				}
+
 				if stop {
 					break
 				}
 
 				// send key to a consumer
-				c <- key
+				c <- &Check{Key: next(), Scheduled: time.Now()}
 			}
 
+			stats.Lock()
 			stats.Iterations++
+			stats.Unlock()
 		}
 
 		close(c)
-		statsChan <- &stats
+		statsChan <- stats
 	}()
 
 	return c
 }
 
-// StartConsumer consumes ItemKeys from a producer channel, queries the Zabbix
-// agent for a response and submits the results to a ThreadStats channel.
-func StartConsumer(producer <-chan *ItemKey, statsChan chan *ThreadStats) {
+// CheckKeys checks a list of keys in sequence for iterationLimit iterations
+// with the given number of consumers and returns their combined stats.
+func CheckKeys(keys ItemKeys, threads int) *ThreadStats {
+	statsChan := make(chan *ThreadStats)
+	scheduler, _ := NewScheduler(ScheduleSequential, keys)
+	producer := StartProducer(keys, scheduler, statsChan)
+	pool := NewConsumerPool(producer, statsChan)
+	pool.Resize(threads)
+
+	totals := NewThreadStats()
+	for i := 0; i < pool.Started()+1; i++ {
+		totals.Add(<-statsChan)
+	}
+
+	return totals
+}
+
+// StartConsumer consumes Checks from a producer channel, queries the Zabbix
+// agent for a response and submits the results to a ThreadStats channel when
+// the producer is closed or the quit channel is closed.
+func StartConsumer(producer <-chan *Check, quit <-chan bool, statsChan chan *ThreadStats) {
 	threadStats := NewThreadStats()
+	monitor.Register(threadStats)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	checks := 0
 
 	// process items as long the producer produces them
-	for key := range producer {
-		keyStats := threadStats.KeyStats[key.Key]
+	for {
+		var check *Check
+		select {
+		case check = <-producer:
+		case <-quit:
+		}
 
-		// Get the value from Zabbix agent
-		val, err := Get(host, key.Key, timeout)
+		if check == nil {
+			break
+		}
+		key := check.Key
 
-		// tally stats
-		if err != nil {
-			threadStats.ErrorCount++
-			keyStats.Error++
-		} else {
-			threadStats.TotalValues++
-			if strings.HasPrefix(val, ErrorMessage) {
-				threadStats.UnsupportedValues++
-				keyStats.NotSupported++
-			} else {
-				keyStats.Success++
-			}
+		// tally time spent waiting for a free consumer
+		result := &Result{QueueDelay: time.Now().Sub(check.Scheduled)}
+		result.Late = result.QueueDelay > lateThreshold
 
-			// Print response
-			if verbose {
-				typ := "item"
-				if key.IsPrototype {
-					typ = "proto"
-				} else if key.IsDiscoveryRule {
-					typ = "disco"
+		// wait until the agent is reachable or due to be probed
+		probe := false
+		if availability != nil {
+			ok := false
+			for !stop {
+				if ok, probe = availability.Acquire(); ok {
+					break
 				}
+				time.Sleep(100 * time.Millisecond)
+			}
 
-				fmt.Printf("[%s] %s: %s\n", typ, key.Key, val)
+			if !ok {
+				continue
 			}
 		}
 
-		threadStats.KeyStats[key.Key] = keyStats
+		// Get the value from Zabbix agent, alternating which agent is checked
+		// first in A/B tests and whether UserParameters are run directly first
+		var resultB, resultDirect *Result
+		bFirst := abTest != nil && checks%2 == 1
+		runDirect := directTest != nil && directTest.Matches(key.Key)
+		directFirst := runDirect && checks%2 == 1
+		checks++
+		if bFirst {
+			resultB = &Result{}
+			Query(hostB, key, resultB, r)
+		}
+		if directFirst {
+			resultDirect = directTest.Run(key.Key, key.TimeoutOr(timeout))
+		}
+
+		Query(host, key, result, r)
+
+		if availability != nil {
+			availability.Report(result.Err, probe)
+		}
+		if result.Err != nil {
+			hooks.RunFirstError(key.Key, result.Err)
+		}
+
+		if abTest != nil {
+			if !bFirst {
+				resultB = &Result{}
+				Query(hostB, key, resultB, r)
+			}
+			abTest.Record(key.Key, result, resultB)
+		}
+
+		if runDirect {
+			if !directFirst {
+				resultDirect = directTest.Run(key.Key, key.TimeoutOr(timeout))
+			}
+			directTest.Record(key.Key, result, resultDirect)
+		}
+
+		// tally stats
+		threadStats.Record(key.Key, result)
+		if valueTracker != nil {
+			valueTracker.Record(key, result)
+		}
+		if snapshot != nil {
+			snapshot.Record(key, result)
+		}
+		if errorFeed != nil {
+			if failure := result.Failure(); failure != "" {
+				errorFeed.Add(key.Key, failure)
+			}
+		}
+
+		// Print response
+		if verbose && result.Err == nil {
+			typ := "item"
+			if key.IsPrototype {
+				typ = "proto"
+			} else if key.IsDiscoveryRule {
+				typ = "disco"
+			}
+
+			fmt.Printf("[%s] %s (%s): %s\n", typ, key.Key, key.OriginString(), result.Value)
+		}
 
 		// sleep
 		if delayMsArg > 0 && !stop {
@@ -285,6 +979,28 @@ func StartConsumer(producer <-chan *ItemKey, statsChan chan *ThreadStats) {
 	statsChan <- threadStats
 }
 
+// Query gets the value of a key from a Zabbix agent, retrying transient
+// errors according to the retry policy, and stores the outcome in the given
+// result.
+func Query(host string, key *ItemKey, result *Result, r *rand.Rand) {
+	for attempt := 1; ; attempt++ {
+		result.Start = time.Now()
+		atomic.AddInt64(&inFlight, 1)
+		result.Value, result.Err = Get(host, key.Key, key.TimeoutOr(timeout))
+		atomic.AddInt64(&inFlight, -1)
+		result.Latency = time.Now().Sub(result.Start)
+		result.FirstTry = result.Err == nil && attempt == 1
+
+		if result.Err == nil || stop || !retryPolicy.ShouldRetry(result.Err, attempt) {
+			return
+		}
+
+		dprintf("Retrying key %s on %s after error: %v\n", key.Key, host, result.Err)
+		result.Retries++
+		time.Sleep(retryPolicy.Delay(attempt, r))
+	}
+}
+
 // dprintf prints debug output if debug is enabled.
 func dprintf(format string, a ...interface{}) {
 	if debug {
@@ -292,10 +1008,25 @@ func dprintf(format string, a ...interface{}) {
 	}
 }
 
+// percent returns n as a percentage of total.
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return 100 * float64(n) / float64(total)
+}
+
 func hl(val int64, color string) string {
 	if val > 0 {
-		return fmt.Sprintf("[%s]%d[default]", color, val)
+		return colorize(color, fmt.Sprintf("%d", val))
 	} else {
 		return fmt.Sprintf("%d", val)
 	}
 }
+
+// colorize returns the given text in the given color. The text is not parsed
+// for color markup, so it may safely contain keys, commands and values.
+func colorize(color, text string) string {
+	return colorstring.Color("["+color+"]") + text + colorstring.Color("[default]")
+}
@@ -17,8 +17,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEnvVarExpansion(t *testing.T) {
@@ -36,3 +48,1161 @@ func TestEnvVarExpansion(t *testing.T) {
 		t.Errorf("Environment variable subsitution failed.\nExpected: %s\nGot:      %s", expected, key.Key)
 	}
 }
+
+func TestDeduplicate(t *testing.T) {
+	keys := ItemKeys{
+		&ItemKey{Key: "agent.ping", Origins: []KeyOrigin{{File: "a.conf", Line: 1}}},
+		&ItemKey{Key: "agent.version", Origins: []KeyOrigin{{File: "a.conf", Line: 2}}},
+		&ItemKey{Key: "agent.ping", Origins: []KeyOrigin{{Rule: "rule", Macros: map[string]string{"{#A}": "b"}}}},
+	}
+
+	keys, conflicts := keys.Deduplicate()
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys after deduplication, got %d", len(keys))
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("Expected no conflicts; got %v", conflicts)
+	}
+
+	expected := "a.conf:1, rule ({#A}=b)"
+	if origins := keys[0].OriginString(); origins != expected {
+		t.Errorf("Origins not merged.\nExpected: %s\nGot:      %s", expected, origins)
+	}
+
+	// a rule listed twice is discovered once with the prototypes of both, and
+	// differing attributes are reported
+	rule := func(line int, weight float64, proto string) *ItemKey {
+		key := NewItemKey("vfs.fs.discovery")
+		key.IsDiscoveryRule = true
+		key.Weight = weight
+		key.Origins = []KeyOrigin{{File: "a.conf", Line: line}}
+		key.Prototypes = ItemKeys{NewItemKey(proto)}
+		return key
+	}
+	keys, conflicts = ItemKeys{rule(1, 1, "vfs.fs.size[{#FSNAME},free]"), rule(5, 2, "vfs.fs.inode[{#FSNAME},pfree]")}.Deduplicate()
+	if len(keys) != 1 || len(keys[0].Prototypes) != 2 {
+		t.Fatalf("Expected 1 rule with 2 prototypes")
+	}
+	if keys[0].Weight != 1 || len(conflicts) != 1 || !strings.Contains(conflicts[0].Error(), "weight") {
+		t.Errorf("Expected the first weight to be kept with a conflict; got %v", conflicts)
+	}
+}
+
+// fakeAgent starts a Zabbix agent on a random local port which answers each
+// request with the value returned by respond for the key and the number of
+// times it has been requested. If respond returns false, the connection is
+// closed without a response. The agent stops when the listener is closed.
+func fakeAgent(t *testing.T, respond func(key string, n int) (string, bool)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make(map[string]int)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			head := make([]byte, DataOffset)
+			if _, err := io.ReadFull(conn, head); err != nil {
+				conn.Close()
+				continue
+			}
+			key := make([]byte, binary.LittleEndian.Uint64(head[DataLengthOffset:]))
+			if _, err := io.ReadFull(conn, key); err != nil {
+				conn.Close()
+				continue
+			}
+
+			requests[string(key)]++
+			if value, ok := respond(string(key), requests[string(key)]); ok {
+				buf := new(bytes.Buffer)
+				buf.Write(HeaderBytes)
+				binary.Write(buf, binary.LittleEndian, HeaderVersion)
+				binary.Write(buf, binary.LittleEndian, int64(len(value)))
+				buf.WriteString(value)
+				conn.Write(buf.Bytes())
+			}
+			conn.Close()
+		}
+	}()
+
+	return l
+}
+
+func TestExpandDiscoveryFailures(t *testing.T) {
+	agent := fakeAgent(t, func(key string, n int) (string, bool) {
+		switch key {
+		case "broken.discovery":
+			return "", false
+
+		case "flaky.discovery":
+			// fails on the first attempt only
+			return `{"data":[{"{#FS}":"/"},{"{#FS}":"/boot"}]}`, n > 1
+		}
+
+		return "1", true
+	})
+	defer agent.Close()
+
+	rule := func(name string) *ItemKey {
+		key := NewItemKey(name)
+		key.IsDiscoveryRule = true
+		key.Prototypes = ItemKeys{NewItemKey("vfs.fs.size[{#FS},free]")}
+		return key
+	}
+	keys := ItemKeys{NewItemKey("agent.ping"), rule("broken.discovery"), rule("flaky.discovery"), NewItemKey("agent.version")}
+
+	keys = keys.Expand(agent.Addr().String(), time.Second, 1, 10*time.Millisecond)
+
+	failures := keys.DiscoveryFailures()
+	if len(failures) != 1 || failures[0].Key != "broken.discovery" {
+		t.Fatalf("Expected only broken.discovery to fail; got %d failures", len(failures))
+	}
+
+	for _, name := range []string{"agent.ping", "agent.version", "flaky.discovery", "vfs.fs.size[/,free]", "vfs.fs.size[/boot,free]"} {
+		if keys.Get(name) == nil {
+			t.Errorf("Expected key to be queued: %s", name)
+		}
+	}
+	if len(keys) != 6 {
+		t.Errorf("Expected 6 keys after expansion; got %d", len(keys))
+	}
+}
+
+func TestKeyFileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", APP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "main.keys"), []byte("agent.ping\ninclude conf.d/*.keys\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "a.keys"), []byte("agent.version\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "b.keys"), []byte("Include=../cycle.keys\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cycle.keys"), []byte("include conf.d/b.keys\n"), 0644)
+
+	keys, err := LoadKeyFiles([]string{filepath.Join(dir, "conf.d", "a.keys"), filepath.Join(dir, "main.keys")})
+	if err == nil {
+		t.Fatalf("Expected include cycle error, got %d keys", len(keys))
+	}
+	if !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Expected include cycle error, got: %v", err)
+	}
+
+	os.Remove(filepath.Join(dir, "conf.d", "b.keys"))
+	keys, err = LoadKeyFiles([]string{filepath.Join(dir, "main.keys")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "agent.ping, agent.version"
+	if names := strings.Join(keys.SortedKeyNames(), ", "); names != expected {
+		t.Errorf("Included keys not loaded.\nExpected: %s\nGot:      %s", expected, names)
+	}
+}
+
+func TestUserParamPlaceholderKey(t *testing.T) {
+	tests := map[string]*UserParameter{
+		"custom.ping": {Key: "custom.ping", Command: "echo $1"},
+		"pgsql.query[{%PGSQL_QUERY_1},{%PGSQL_QUERY_2}]": {Key: "pgsql.query", Flexible: true, Command: "psql -h $1 -c \"$2\""},
+		"pgsql.all[]": {Key: "pgsql.all", Flexible: true, Command: "echo $$"},
+	}
+
+	for expected, param := range tests {
+		if key := param.PlaceholderKey(); key != expected {
+			t.Errorf("Bad placeholder key.\nExpected: %s\nGot:      %s", expected, key)
+		}
+	}
+}
+
+func TestSplitKeyLine(t *testing.T) {
+	tests := [][3]string{
+		{"agent.ping", "agent.ping", ""},
+		{"  agent.ping   weight=2 ", "  agent.ping", "weight=2"},
+		{`vfs.file.exists["/tmp/my file]"] interval=30s`, `vfs.file.exists["/tmp/my file]"]`, "interval=30s"},
+		{`net.if.in[{#IFNAME},[a b]] weight=3`, `net.if.in[{#IFNAME},[a b]]`, "weight=3"},
+	}
+
+	for _, test := range tests {
+		key, attrs := SplitKeyLine(test[0])
+		if key != test[1] || attrs != test[2] {
+			t.Errorf("Bad key line split for: %s\nExpected: '%s' '%s'\nGot:      '%s' '%s'", test[0], test[1], test[2], key, attrs)
+		}
+	}
+
+	attrs, err := ParseKeyAttributes(`weight=2 regex="a b\"c"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs["weight"] != "2" || attrs["regex"] != `a b"c` {
+		t.Errorf("Bad key attributes: %v", attrs)
+	}
+}
+
+func TestWeightedScheduler(t *testing.T) {
+	keys := ItemKeys{
+		&ItemKey{Key: "cheap", Interval: &UpdateInterval{Delay: 30 * time.Second}},
+		&ItemKey{Key: "expensive", Interval: &UpdateInterval{Delay: time.Hour}},
+	}
+
+	next, err := NewScheduler(ScheduleWeighted, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 121; i++ {
+		counts[next().Key]++
+	}
+
+	if counts["cheap"] != 120 || counts["expensive"] != 1 {
+		t.Errorf("Keys not scheduled proportionally: %v", counts)
+	}
+}
+
+func TestUpdateInterval(t *testing.T) {
+	interval, err := ParseUpdateInterval("1h;30s/1-5,09:00-18:00;wd6h12m30;0/7,00:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Monday 2016-10-10 is a business day
+	tests := [][2]time.Time{
+		{time.Date(2016, 10, 10, 9, 0, 10, 0, time.UTC), time.Date(2016, 10, 10, 9, 0, 30, 0, time.UTC)},
+		{time.Date(2016, 10, 10, 20, 10, 0, 0, time.UTC), time.Date(2016, 10, 10, 21, 0, 0, 0, time.UTC)},
+		{time.Date(2016, 10, 15, 11, 0, 0, 0, time.UTC), time.Date(2016, 10, 15, 12, 0, 0, 0, time.UTC)},
+		{time.Date(2016, 10, 15, 12, 0, 0, 0, time.UTC), time.Date(2016, 10, 15, 12, 30, 0, 0, time.UTC)},
+		{time.Date(2016, 10, 16, 10, 0, 0, 0, time.UTC), time.Date(2016, 10, 17, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		if next := interval.Next(test[0], 0); !next.Equal(test[1]) {
+			t.Errorf("Bad next check after %s\nExpected: %s\nGot:      %s", test[0], test[1], next)
+		}
+	}
+
+	if _, err := ParseUpdateInterval("50s;wd1-5h9-18/30s"); err != nil {
+		t.Errorf("Failed to parse flexible interval with scheduling period: %v", err)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	a, b := LatencyHistogram{}, LatencyHistogram{}
+	for i := 1; i <= 50; i++ {
+		a.Observe(time.Duration(i) * time.Millisecond)
+		b.Observe(time.Duration(i+50) * time.Millisecond)
+	}
+	a.Add(b)
+
+	if a.Count != 100 || a.Min != time.Millisecond || a.Max != 100*time.Millisecond {
+		t.Fatalf("Bad histogram totals: count %d, min %s, max %s", a.Count, a.Min, a.Max)
+	}
+
+	// estimates must be within the 30% bucket width
+	for _, p := range []float64{50, 95, 99} {
+		expected := time.Duration(p) * time.Millisecond
+		if got := a.Percentile(p); got < expected*7/10 || got > expected*13/10 {
+			t.Errorf("Bad p%v estimate.\nExpected: ~%s\nGot:      %s", p, expected, got)
+		}
+	}
+}
+
+func TestKeyReportAtRisk(t *testing.T) {
+	// a key allowed longer than the agent is still abandoned by the agent
+	key := NewItemKey("vfs.dir.size[/var]")
+	key.Timeout = 30 * time.Second
+
+	slow, fast := KeyStats{}, KeyStats{}
+	for i := 0; i < 20; i++ {
+		slow.Latency.Observe(4 * time.Second)
+		fast.Latency.Observe(500 * time.Millisecond)
+	}
+
+	report := NewKeyReport(key, slow, 3*time.Second, 0.8)
+	if !report.AtRisk {
+		t.Errorf("Expected key with p95 above the agent timeout to be at risk")
+	}
+	if report.Timeout != 3*time.Second {
+		t.Errorf("Expected agent timeout in report; got %s", report.Timeout)
+	}
+
+	if report := NewKeyReport(key, fast, 3*time.Second, 0.8); report.AtRisk {
+		t.Errorf("Expected fast key not to be at risk")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy, err := NewRetryPolicy(3, 100*time.Millisecond, time.Second, "refused,timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// find a closed port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = Get(addr, "agent.ping", time.Second)
+	if class := ErrorClass(err); class != ErrorClassRefused {
+		t.Fatalf("Expected error class %s, got %s: %v", ErrorClassRefused, class, err)
+	}
+
+	if !policy.ShouldRetry(err, 3) || policy.ShouldRetry(err, 4) {
+		t.Errorf("Retry policy did not respect maximum retries")
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		if delay := policy.Delay(attempt+1, r); delay < max/2 || delay > max {
+			t.Errorf("Bad delay for attempt %d: %s", attempt+1, delay)
+		}
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	a := &Availability{
+		ErrorLimit:        2,
+		UnreachablePeriod: time.Hour,
+		UnreachableDelay:  10 * time.Millisecond,
+		UnavailableDelay:  time.Hour,
+	}
+
+	failed := NewError(nil, "connection refused")
+	a.Report(failed, false)
+	if ok, _ := a.Acquire(); !ok {
+		t.Fatalf("Agent unreachable after a single error")
+	}
+
+	a.Report(failed, false)
+	if ok, _ := a.Acquire(); ok {
+		t.Fatalf("Agent still reachable after error limit")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	ok, probe := a.Acquire()
+	if !ok || !probe {
+		t.Fatalf("Agent not probed after unreachable delay")
+	}
+	if ok, _ := a.Acquire(); ok {
+		t.Fatalf("Agent probed concurrently")
+	}
+
+	a.Report(nil, true)
+	outages := a.Outages()
+	if a.State() != AgentAvailable || len(outages) != 1 || outages[0].End.IsZero() {
+		t.Errorf("Outage not recorded: %+v", outages)
+	}
+}
+
+func TestThreadStatsDelta(t *testing.T) {
+	stats := NewThreadStats()
+	stats.Record("agent.ping", &Result{Value: "1", Latency: time.Millisecond, FirstTry: true})
+	prev := stats.Snapshot()
+
+	stats.Record("agent.ping", &Result{Value: "1", Latency: 2 * time.Millisecond, FirstTry: true})
+	stats.Record("agent.ping", &Result{Err: NewError(nil, "timeout"), Latency: time.Second})
+	stats.Record("bad.key", &Result{Value: ErrorMessage, Latency: time.Millisecond})
+
+	delta := stats.Snapshot().Delta(prev)
+	if delta.TotalValues != 2 || delta.ErrorCount != 1 || delta.UnsupportedValues != 1 || delta.Latency.Count != 3 {
+		t.Errorf("Bad stats delta: %+v", delta)
+	}
+
+	keyStats := delta.KeyStats["agent.ping"]
+	if keyStats.Success != 1 || keyStats.Error != 1 || keyStats.FirstTry != 1 || keyStats.Latency.Count != 2 {
+		t.Errorf("Bad key stats delta: %+v", keyStats)
+	}
+}
+
+func TestConsumerPool(t *testing.T) {
+	defer func(h string, d time.Duration) { host, timeout = h, d }(host, timeout)
+	agent := fakeAgent(t, func(key string, n int) (string, bool) { return "1", true })
+	defer agent.Close()
+	host, timeout = agent.Addr().String(), time.Second
+
+	producer := make(chan *Check)
+	statsChan := make(chan *ThreadStats)
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			producer <- &Check{Key: NewItemKey("agent.ping"), Scheduled: time.Now()}
+		}
+	}
+
+	values := int64(0)
+	receive := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case stats := <-statsChan:
+				values += stats.TotalValues
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for consumer %d of %d to report stats", i+1, n)
+			}
+		}
+	}
+
+	pool := NewConsumerPool(producer, statsChan)
+	pool.Resize(3)
+	send(10)
+
+	// shrinking stops the newest consumers, which report as they exit
+	pool.Resize(1)
+	receive(2)
+	if pool.Size() != 1 || pool.Started() != 3 {
+		t.Fatalf("Expected 1 of 3 consumers running; got %d of %d", pool.Size(), pool.Started())
+	}
+
+	pool.Resize(4)
+	send(10)
+	if pool.Size() != 4 || pool.Started() != 6 {
+		t.Fatalf("Expected 4 of 6 consumers running; got %d of %d", pool.Size(), pool.Started())
+	}
+
+	// the remaining consumers report when the producer is closed
+	close(producer)
+	receive(4)
+	select {
+	case <-statsChan:
+		t.Errorf("Expected each consumer to report stats once")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if values != 20 {
+		t.Errorf("Expected 20 values from all consumers; got %d", values)
+	}
+}
+
+func TestErrorFeed(t *testing.T) {
+	feed := NewErrorFeed(3)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		feed.Add(key, "ZBX_NOTSUPPORTED")
+	}
+
+	entries := feed.Latest(10)
+	if len(entries) != 3 {
+		t.Fatalf("Expected feed limited to 3 entries; got %d", len(entries))
+	}
+	for i, key := range []string{"e", "d", "c"} {
+		if entries[i].Key != key {
+			t.Errorf("Expected entry %d to be %s; got %s", i, key, entries[i].Key)
+		}
+	}
+
+	if entries := feed.Latest(1); len(entries) != 1 || entries[0].Key != "e" {
+		t.Errorf("Expected only the newest entry")
+	}
+}
+
+func TestSamplerTimeSeriesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", APP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each format has a row for the totals and each key in both samples
+	expected := []struct {
+		key      string
+		requests int64
+	}{{"*", 3}, {"a", 2}, {"b", 1}, {"*", 2}, {"a", 2}, {"b", 0}}
+
+	for _, format := range []string{FormatCSV, FormatJSONLines} {
+		path := filepath.Join(dir, "series."+format)
+		w, err := NewTimeSeriesFile(path, format)
+		if err != nil {
+			t.Fatalf("Error creating %s file: %v", format, err)
+		}
+
+		m := NewMonitor()
+		stats := NewThreadStats()
+		m.Register(stats)
+
+		// samples are taken by hand rather than waiting for the ticker
+		sampler := NewSampler(m, time.Hour)
+		sampler.AddWriter(w)
+		sampler.Start()
+
+		stats.Record("a", &Result{Value: "1", Latency: time.Millisecond})
+		stats.Record("a", &Result{Value: "1", Latency: time.Millisecond})
+		stats.Record("b", &Result{Value: "1", Latency: time.Millisecond})
+		sampler.sample()
+
+		stats.Record("a", &Result{Value: "1", Latency: time.Millisecond})
+		stats.Record("a", &Result{Value: ZBX_NOTSUPPORTED, Latency: time.Millisecond})
+		sampler.Stop()
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		points := []*SeriesPoint{}
+		if format == FormatCSV {
+			rows, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+			if err != nil {
+				t.Fatalf("Error reading CSV: %v", err)
+			}
+			if len(rows) == 0 || rows[0][2] != "key" || rows[0][3] != "requests" {
+				t.Fatalf("Missing CSV header")
+			}
+			for _, row := range rows[1:] {
+				requests, _ := strconv.ParseInt(row[3], 10, 64)
+				unsupported, _ := strconv.ParseInt(row[5], 10, 64)
+				points = append(points, &SeriesPoint{Key: row[2], Requests: requests, Unsupported: unsupported})
+			}
+		} else {
+			for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+				point := &SeriesPoint{}
+				if err := json.Unmarshal([]byte(line), point); err != nil {
+					t.Fatalf("Error reading JSON line: %v", err)
+				}
+				points = append(points, point)
+			}
+		}
+
+		if len(points) != len(expected) {
+			t.Fatalf("Expected %d %s rows; got %d", len(expected), format, len(points))
+		}
+		for i, point := range points {
+			if point.Key != expected[i].key || point.Requests != expected[i].requests {
+				t.Errorf("Bad %s row %d.\nExpected: %s %d\nGot:      %s %d", format, i+1, expected[i].key, expected[i].requests, point.Key, point.Requests)
+			}
+		}
+		if points[3].Unsupported != 1 {
+			t.Errorf("Expected 1 unsupported value in %s totals of the last sample; got %d", format, points[3].Unsupported)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	stats := NewThreadStats()
+	stats.Record(`vfs.file.exists["C:\x"]`, &Result{Value: "1", Latency: time.Millisecond})
+	stats.Record("agent.ping", &Result{Err: NewError(nil, "timeout"), Latency: time.Second})
+
+	var b strings.Builder
+	if err := WriteMetrics(&b, stats, 2, 4, 3); err != nil {
+		t.Fatalf("Error writing metrics: %v", err)
+	}
+
+	for _, line := range []string{
+		`zabbix_agent_bench_requests_total{key="vfs.file.exists[\"C:\\x\"]",result="success"} 1`,
+		`zabbix_agent_bench_requests_total{key="agent.ping",result="error"} 1`,
+		`zabbix_agent_bench_request_duration_seconds_bucket{le="+Inf"} 2`,
+		`zabbix_agent_bench_request_duration_seconds_count 2`,
+		`zabbix_agent_bench_in_flight_requests 2`,
+		`zabbix_agent_bench_threads 4`,
+		`zabbix_agent_bench_running_threads 3`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("Metrics missing line: %s", line)
+		}
+	}
+}
+
+func TestInfluxWriter(t *testing.T) {
+	// stand-in for an InfluxDB UDP listener
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer conn.Close()
+
+	w, err := NewInfluxWriter("udp://"+conn.LocalAddr().String(), "db01")
+	if err != nil {
+		t.Fatalf("Error creating writer: %v", err)
+	}
+	defer w.Close()
+
+	stats := NewThreadStats()
+	stats.Record("vfs.fs.size[/,free]", &Result{Value: "1024", Latency: time.Millisecond})
+	sample := &Sample{Time: time.Unix(1, 0), Elapsed: time.Second, Interval: time.Second, Stats: stats}
+	if err := w.WriteSample(sample); err != nil {
+		t.Fatalf("Error writing sample: %v", err)
+	}
+
+	expect := []string{
+		"zabbix_agent_bench,host=db01 requests=1i,success=1i,unsupported=0i,errors=0i,rate=1,",
+		`zabbix_agent_bench,host=db01,key=vfs.fs.size[/\,free] requests=1i,`,
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, prefix := range expect {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error reading from writer: %v", err)
+		}
+
+		line := string(buf[:n])
+		if !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, " 1000000000\n") {
+			t.Errorf("Bad line protocol; expected %s..., got %q", prefix, line)
+		}
+	}
+}
+
+func TestGraphiteName(t *testing.T) {
+	if name := graphiteName(`db01:10050`); name != "db01_10050" {
+		t.Errorf("Bad Graphite name: %s", name)
+	}
+
+	for key, expected := range map[string]string{
+		"agent.ping":          "agent_ping",
+		"system-cpu.util":     "system-cpu_util",
+		"agent_ping":          "agent_ping__",
+		graphiteTotals:        graphiteTotals + "__",
+		`vfs.fs.size[/,free]`: "vfs_fs_size_free__",
+	} {
+		if name := graphiteKey(key); !strings.HasPrefix(name, expected) || (!strings.HasSuffix(expected, "__") && name != expected) {
+			t.Errorf("Bad Graphite name for %s: %s", key, name)
+		}
+	}
+
+	// keys which differ only in replaced characters must not collide
+	for _, keys := range [][2]string{
+		{`vfs.fs.size[/,free]`, `vfs.fs.size[,free]`},
+		{"agent.ping", "agent_ping"},
+		{"a.b_c", "a_b.c"},
+	} {
+		if graphiteKey(keys[0]) == graphiteKey(keys[1]) {
+			t.Errorf("Graphite names collide for %s and %s: %s", keys[0], keys[1], graphiteKey(keys[0]))
+		}
+	}
+	if graphiteKey("all") == graphiteTotals {
+		t.Errorf("Graphite name of key 'all' collides with the totals")
+	}
+}
+
+func TestHTMLReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zabbix_agent_bench")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats := NewThreadStats()
+	stats.Record("agent.ping", &Result{Value: "1", Latency: time.Millisecond})
+	stats.Record("<script>", &Result{Value: ErrorMessage + "\x00Unsupported item key.", Latency: time.Millisecond})
+
+	report := &RunReport{
+		Host:     "localhost",
+		Duration: time.Second,
+		Totals:   stats,
+		Keys: []*KeyReport{
+			{Key: "<script>", Stats: stats.KeyStats["<script>"]},
+			{Key: "agent.ping", Stats: stats.KeyStats["agent.ping"]},
+		},
+		History: []*SeriesPoint{{Rate: 1}, {Rate: 2}},
+	}
+
+	path := filepath.Join(dir, "report.html")
+	if err := report.WriteReport(path, ReportHTML); err != nil {
+		t.Fatalf("Error writing report: %v", err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	html := string(b)
+	if strings.Contains(html, "<script>") || !strings.Contains(html, "&lt;script&gt;") {
+		t.Errorf("Key names not escaped in HTML report")
+	}
+	if !strings.Contains(html, "Unsupported item key.") {
+		t.Errorf("Failure reason missing from HTML report")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	newReport := func(latency time.Duration, unsupported int) *RunReport {
+		stats := NewThreadStats()
+		for i := 0; i < 100; i++ {
+			value := "1"
+			if i < unsupported {
+				value = ErrorMessage
+			}
+			stats.Record("agent.ping", &Result{Value: value, Latency: time.Millisecond})
+			stats.Record("system.cpu.load", &Result{Value: "1", Latency: latency})
+		}
+
+		return &RunReport{
+			Duration: time.Second,
+			Totals:   stats,
+			Keys: []*KeyReport{
+				{Key: "agent.ping", Stats: stats.KeyStats["agent.ping"]},
+				{Key: "system.cpu.load", Stats: stats.KeyStats["system.cpu.load"]},
+			},
+		}
+	}
+
+	limits := Thresholds{LatencyIncrease: 20, MinLatencyIncrease: time.Millisecond, NVPSDecrease: 10, FailureIncrease: 1}
+	if c := Compare(newReport(10*time.Millisecond, 0), newReport(11*time.Millisecond, 1), limits); c.Regressed() {
+		t.Errorf("Unexpected regressions: %v, %v, %v", c.Regressions, c.Keys[0].Regressions, c.Keys[1].Regressions)
+	}
+
+	c := Compare(newReport(10*time.Millisecond, 0), newReport(50*time.Millisecond, 5), limits)
+	if !c.Regressed() || len(c.Keys[0].Regressions) != 1 || len(c.Keys[1].Regressions) != 1 {
+		t.Errorf("Expected latency and failure regressions; got %v, %v", c.Keys[0].Regressions, c.Keys[1].Regressions)
+	}
+}
+
+func TestABTest(t *testing.T) {
+	ab := NewABTest("a", "b")
+	ab.Record("agent.version", &Result{Value: "5.0.0"}, &Result{Value: "5.0.1"})
+	ab.Record("agent.ping", &Result{Value: "1"}, &Result{Value: "1"})
+	ab.Record("vfs.fs.size[/,free]", &Result{Value: "1024"}, &Result{Value: ErrorMessage})
+
+	if stats := ab.Get("agent.version"); stats.Pairs != 1 || stats.ValueDiffs != 1 || stats.TypeDiffs != 0 {
+		t.Errorf("Expected a value difference; got %+v", stats)
+	}
+
+	if stats := ab.Get("agent.ping"); stats.ValueDiffs+stats.TypeDiffs != 0 {
+		t.Errorf("Expected no differences; got %+v", stats)
+	}
+
+	if stats := ab.Get("vfs.fs.size[/,free]"); stats.TypeDiffs != 1 || stats.B.NotSupported != 1 {
+		t.Errorf("Expected a type difference; got %+v", stats)
+	}
+
+	for value, typ := range map[string]string{"1": ValueTypeInteger, "18446744073709551615": ValueTypeInteger, "0.5": ValueTypeFloat, "": ValueTypeEmpty, "Linux": ValueTypeText} {
+		if v := ValueType(&Result{Value: value}); v != typ {
+			t.Errorf("Expected type %s for %q; got %s", typ, value, v)
+		}
+	}
+}
+
+func TestValueTracker(t *testing.T) {
+	tracker := NewValueTracker()
+	counter := &ItemKey{Key: "net.if.in[eth0]"}
+	t0 := time.Now()
+
+	// overlapping checks may complete out of order
+	tracker.Record(counter, &Result{Value: "200", Start: t0.Add(time.Millisecond), Latency: time.Millisecond})
+	tracker.Record(counter, &Result{Value: "100", Start: t0, Latency: 5 * time.Millisecond})
+	if n := tracker.Get(counter.Key).Decreases; n != 0 {
+		t.Errorf("Expected overlapping checks to be ignored; got %d decreases", n)
+	}
+
+	tracker.Record(counter, &Result{Value: "50", Start: t0.Add(10 * time.Millisecond), Latency: time.Millisecond})
+	if n := tracker.Get(counter.Key).Decreases; n != 1 {
+		t.Errorf("Expected 1 counter decrease; got %d", n)
+	}
+
+	version := &ItemKey{Key: "agent.version"}
+	tracker.Record(version, &Result{Value: "5.0.0", Start: t0, Latency: time.Millisecond})
+	tracker.Record(version, &Result{Value: ErrorMessage, Start: t0.Add(time.Second), Latency: time.Millisecond})
+	tracker.Record(version, &Result{Value: "5.0.1", Start: t0.Add(2 * time.Second), Latency: time.Millisecond})
+	if track := tracker.Get(version.Key); track.Flips != 2 || track.Changes != 0 {
+		t.Errorf("Expected 2 flips and no changes; got %+v", track)
+	}
+	tracker.Record(version, &Result{Value: "5.0.2", Start: t0.Add(3 * time.Second), Latency: time.Millisecond})
+	if track := tracker.Get(version.Key); track.Changes != 1 {
+		t.Errorf("Expected 1 change of a constant value; got %+v", track)
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	tests := []struct {
+		rule     string
+		expected string
+		value    string
+		match    bool
+	}{
+		{"exact", "1", "1", true},
+		{"exact", "1", "2", false},
+		{"numeric", "1", "2.5", true},
+		{"numeric", "1", "", false},
+		{"any", "x", "", true},
+		{"any", "x", ErrorMessage, false},
+		{"regex:^5\\.0\\.", "5.0.1", "5.0.2", true},
+		{"regex:^5\\.0\\.", "5.0.1", "6.0.0", false},
+		{"json-ignore:size,free", `{"data":[{"{#FS}":"/","size":1}]}`, `{"data":[{"size":2,"{#FS}":"/"}]}`, true},
+		{"json-ignore:size", `{"data":[{"{#FS}":"/","size":1}]}`, `{"data":[{"{#FS}":"/boot","size":1}]}`, false},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseMatchRule(test.rule)
+		if err != nil {
+			t.Errorf("Error parsing match rule %s: %v", test.rule, err)
+			continue
+		}
+
+		expected := &SnapshotEntry{Value: test.expected}
+		if match := rule.Match(expected, &Result{Value: test.value}); match != test.match {
+			t.Errorf("Expected match %v for %q with rule %s; got %v", test.match, test.value, test.rule, match)
+		}
+	}
+
+	if _, err := ParseMatchRule("fuzzy"); err == nil {
+		t.Errorf("Expected error for unknown match rule")
+	}
+}
+
+func TestSnapshotSavedRule(t *testing.T) {
+	dir, err := ioutil.TempDir("", APP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	uptime := NewItemKey("system.uptime")
+	uptime.Match, _ = ParseMatchRule(MatchNumeric)
+	ping := NewItemKey("agent.ping")
+
+	recorder, err := NewSnapshot(SnapshotRecord, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Record(uptime, &Result{Value: "100"})
+	recorder.Record(ping, &Result{Value: "1"})
+	if err := recorder.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys read again without their match attribute use the saved rule
+	verifier, err := NewSnapshot(SnapshotVerify, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.Record(NewItemKey("system.uptime"), &Result{Value: "160"})
+	verifier.Record(NewItemKey("agent.ping"), &Result{Value: "0"})
+
+	if n := verifier.mismatches["system.uptime"].Mismatches; n != 0 {
+		t.Errorf("Expected saved numeric rule to match; got %d mismatches", n)
+	}
+	if n := verifier.mismatches["agent.ping"].Mismatches; n != 1 {
+		t.Errorf("Expected saved exact rule to mismatch; got %d mismatches", n)
+	}
+
+	// a rule in the key file takes precedence
+	strict := NewItemKey("system.uptime")
+	strict.Match, _ = ParseMatchRule(MatchExact)
+	verifier.Record(strict, &Result{Value: "160"})
+	if n := verifier.mismatches["system.uptime"].Mismatches; n != 1 {
+		t.Errorf("Expected key rule to take precedence; got %d mismatches", n)
+	}
+}
+
+func TestResourceTrend(t *testing.T) {
+	start := time.Now()
+	rising := make([]*ProcessSample, 20)
+	flat := make([]*ProcessSample, 20)
+	for i := range rising {
+		when := start.Add(time.Duration(i) * time.Minute)
+		rising[i] = &ProcessSample{Time: when, FDs: int64(100 + i)}
+		flat[i] = &ProcessSample{Time: when, FDs: int64(100 + i%2)}
+	}
+
+	fds := func(s *ProcessSample) float64 { return float64(s.FDs) }
+	if trend := NewResourceTrend("fds", rising, fds, nil); trend.Verdict != VerdictLeak {
+		t.Errorf("Expected leak for steadily rising FDs; got %s", trend.Verdict)
+	} else if trend.Slope < 59 || trend.Slope > 61 {
+		t.Errorf("Expected slope of 60 per hour; got %f", trend.Slope)
+	}
+
+	if trend := NewResourceTrend("fds", flat, fds, nil); trend.Verdict != VerdictStable {
+		t.Errorf("Expected stable FDs; got %s", trend.Verdict)
+	}
+
+	if trend := NewResourceTrend("fds", rising[:3], fds, nil); trend.Verdict != VerdictTooShort {
+		t.Errorf("Expected too few samples; got %s", trend.Verdict)
+	}
+
+	// a leak after a restart is hidden by the higher usage of the old process
+	restarted := make([]*ProcessSample, 0)
+	for i := 0; i < 10; i++ {
+		restarted = append(restarted, &ProcessSample{Time: start.Add(time.Duration(i-10) * time.Minute), PID: 1, FDs: 500})
+	}
+	for _, sample := range rising {
+		restarted = append(restarted, &ProcessSample{Time: sample.Time, PID: 2, FDs: sample.FDs})
+	}
+
+	last := LastProcessSamples(restarted)
+	if len(last) != len(rising) || last[0].PID != 2 {
+		t.Fatalf("Expected %d samples of the last PID; got %d", len(rising), len(last))
+	}
+	if trend := NewResourceTrend("fds", last, fds, nil); trend.Verdict != VerdictLeak {
+		t.Errorf("Expected leak after restart; got %s", trend.Verdict)
+	}
+	if len(LastProcessSamples(nil)) != 0 {
+		t.Errorf("Expected no samples")
+	}
+}
+
+func TestIsolationGroups(t *testing.T) {
+	rule := NewItemKey("vfs.fs.discovery")
+	rule.IsDiscoveryRule = true
+	keys := ItemKeys{NewItemKey("agent.ping"), rule}
+	for _, fs := range []string{"/", "/boot"} {
+		proto := NewItemKey("vfs.fs.size[" + fs + "]")
+		proto.IsPrototype = true
+		proto.Origins = []KeyOrigin{{Rule: rule.Key}}
+		keys = append(keys, proto)
+	}
+
+	groups := keys.IsolationGroups()
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 isolation groups; got %d", len(groups))
+	}
+	if groups[1].Name != rule.Key || len(groups[1].Keys) != 3 {
+		t.Errorf("Expected discovery rule grouped with 2 prototypes; got %s with %d keys", groups[1].Name, len(groups[1].Keys))
+	}
+
+	sample := func(pid int, fds, rss int64) *ProcessSample {
+		return &ProcessSample{PID: pid, FDs: fds, RSS: rss}
+	}
+	results := []*IsolationResult{
+		{Name: "flat", Before: sample(1, 10, 100), After: sample(1, 10, 100)},
+		{Name: "rss", Before: sample(1, 10, 100), After: sample(1, 10, 200)},
+		{Name: "fds", Before: sample(1, 10, 100), After: sample(1, 12, 100)},
+		{Name: "crash", Before: sample(1, 10, 100), After: sample(2, 5, 50), Restarted: true},
+	}
+	RankIsolationResults(results)
+
+	for i, name := range []string{"crash", "fds", "rss", "flat"} {
+		if results[i].Name != name {
+			t.Errorf("Expected %s ranked %d; got %s", name, i+1, results[i].Name)
+		}
+	}
+}
+
+func TestMinimizeKeys(t *testing.T) {
+	keys := ItemKeys{}
+	for i := 0; i < 50; i++ {
+		keys = append(keys, NewItemKey("key"+strconv.Itoa(i)))
+	}
+
+	// the agent goes down only if both keys are checked
+	trials := 0
+	culprits, err := MinimizeKeys(keys, func(keys ItemKeys) (bool, error) {
+		trials++
+		return keys.Get("key7") != nil && keys.Get("key42") != nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Error minimizing keys: %v", err)
+	}
+
+	if len(culprits) != 2 || culprits[0].Key != "key7" || culprits[1].Key != "key42" {
+		t.Errorf("Expected key7 and key42; got %d keys", len(culprits))
+	}
+	if trials > 2*len(keys) {
+		t.Errorf("Expected at most %d trials; got %d", 2*len(keys), trials)
+	}
+
+	// a single key should be found by bisecting
+	trials = 0
+	culprits, _ = MinimizeKeys(keys, func(keys ItemKeys) (bool, error) {
+		trials++
+		return keys.Get("key23") != nil, nil
+	})
+	if len(culprits) != 1 || culprits[0].Key != "key23" {
+		t.Errorf("Expected key23; got %d keys", len(culprits))
+	}
+	if trials > 12 {
+		t.Errorf("Expected at most 12 trials; got %d", trials)
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	result := RunHook(HookStage, "echo $BENCH_HOOK $BENCH_STAGE; exit 3", time.Second, "BENCH_STAGE=benchmark")
+	if result.ExitCode != 3 || !result.Failed() {
+		t.Errorf("Expected exit code 3; got %d", result.ExitCode)
+	}
+	if result.Output != "stage benchmark\n" {
+		t.Errorf("Expected hook and stage in output; got %q", result.Output)
+	}
+
+	result = RunHook(HookAfter, "sleep 5", 100*time.Millisecond)
+	if result.Error == "" || result.Duration > 3*time.Second {
+		t.Errorf("Expected hook to time out; got %s after %s", result.Describe(), result.Duration)
+	}
+
+	hooks := &Hooks{Stage: "true"}
+	hooks.RunBefore()
+	hooks.RunStage("benchmark")
+	hooks.RunFirstError("key", NewError(nil, "error"))
+	hooks.RunAfter()
+	if results := hooks.Results(); len(results) != 1 || results[0].Stage != "benchmark" {
+		t.Errorf("Expected only the stage hook to run; got %d hooks", len(results))
+	}
+
+	// the after hook runs once, whether the run ended or failed first
+	hooks = &Hooks{After: "true"}
+	hooks.RunAfter()
+	hooks.RunAfter()
+	if results := hooks.Results(); len(results) != 1 {
+		t.Errorf("Expected the after hook to run once; got %d hooks", len(results))
+	}
+}
+
+func TestAgentLog(t *testing.T) {
+	line, err := ParseAgentLogLine("  1234:20240102:030405.678 Requested [agent.ping]")
+	if err != nil {
+		t.Fatalf("Error parsing agent log line: %v", err)
+	}
+	if line.PID != 1234 || line.Time.Hour() != 3 || line.Time.Nanosecond() != 678000000 || line.Message != "Requested [agent.ping]" {
+		t.Errorf("Incorrectly parsed agent log line: %s", line)
+	}
+	if _, err := ParseAgentLogLine("not a log line"); err == nil {
+		t.Errorf("Expected error parsing invalid agent log line")
+	}
+
+	log := NewAgentLog("", ItemKeys{NewItemKey("agent.ping"), NewItemKey("system.run[false]")})
+	for _, s := range []string{
+		"  1001:20240102:030405.000 Requested [system.run[false]]",
+		"  1002:20240102:030405.001 Requested [agent.ping]",
+		"  1001:20240102:030405.002 Failed to execute command \"false\"",
+		"  1002:20240102:030405.003 Sending back [1]",
+		"  1003:20240102:030405.004 cannot process system.run[false]: disabled",
+		"  1003:20240102:030405.005 unrelated",
+	} {
+		log.Add(s)
+	}
+
+	lines := log.Lines("system.run[false]")
+	if len(lines) != 3 || !strings.Contains(lines[1], "Failed to execute") || !strings.Contains(lines[2], "cannot process") {
+		t.Errorf("Expected 3 lines for system.run[false]; got %q", lines)
+	}
+	if lines := log.Lines("agent.ping"); len(lines) != 2 {
+		t.Errorf("Expected 2 lines for agent.ping; got %q", lines)
+	}
+	if log.Count() != 6 {
+		t.Errorf("Expected 6 lines read; got %d", log.Count())
+	}
+
+	// a failure is kept after more successful checks than lines are kept
+	log = NewAgentLog("", ItemKeys{NewItemKey("system.cpu.load"), NewItemKey("system.run[false]")})
+	log.Add("  1001:20240102:030405.000 Requested [system.run[false]]")
+	log.Add("  1001:20240102:030405.001 Failed to execute command \"false\"")
+	log.Add("  1001:20240102:030405.002 Sending back [ZBX_NOTSUPPORTED: Cannot execute command.]")
+	for i := 0; i < 2*maxKeyLogLines; i++ {
+		log.Add("  1001:20240102:030406.000 Requested [system.run[false]]")
+		log.Add("  1001:20240102:030406.001 Sending back [0]")
+	}
+
+	lines = log.Lines("system.run[false]")
+	if len(lines) != maxKeyLogLines || !strings.Contains(lines[0], "Failed to execute") || !strings.Contains(lines[1], "ZBX_NOTSUPPORTED") {
+		t.Errorf("Expected failure lines to be kept ahead of routine lines; got %q", lines)
+	}
+	if !strings.Contains(lines[len(lines)-1], "Sending back [0]") {
+		t.Errorf("Expected the most recent routine line last; got %q", lines)
+	}
+
+	// a key with parameters does not name the same key without them
+	log.Add("  1002:20240102:030407.000 cannot process system.cpu.load[all,avg1]: error")
+	if lines := log.Lines("system.cpu.load"); len(lines) != 0 {
+		t.Errorf("Expected no lines for system.cpu.load; got %q", lines)
+	}
+	log.Add("  1002:20240102:030407.001 item system.cpu.load: error")
+	if lines := log.Lines("system.cpu.load"); len(lines) != 1 {
+		t.Errorf("Expected 1 line for system.cpu.load; got %q", lines)
+	}
+}
+
+func TestParseKeyParams(t *testing.T) {
+	tests := []struct {
+		key    string
+		name   string
+		params []string
+	}{
+		{"agent.ping", "agent.ping", nil},
+		{"vfs.fs.size[/,free]", "vfs.fs.size", []string{"/", "free"}},
+		{`vfs.fs.size["/my fs", free]`, "vfs.fs.size", []string{"/my fs", "free"}},
+		{`echo["a \"b\"",,c ]`, "echo", []string{`a "b"`, "", "c "}},
+		{"net.if.in[[eth0,eth1],bytes]", "net.if.in", []string{"[eth0,eth1]", "bytes"}},
+		{"key[]", "key", []string{""}},
+	}
+
+	for _, test := range tests {
+		name, params, err := ParseKeyParams(test.key)
+		if err != nil {
+			t.Errorf("Error parsing key %s: %v", test.key, err)
+			continue
+		}
+
+		if name != test.name || strings.Join(params, "|") != strings.Join(test.params, "|") || len(params) != len(test.params) {
+			t.Errorf("Expected %s %q for %s; got %s %q", test.name, test.params, test.key, name, params)
+		}
+	}
+
+	if _, _, err := ParseKeyParams(`key["unterminated]`); err == nil {
+		t.Errorf("Expected error for unterminated quoted parameter")
+	}
+}
+
+func TestUserParameterCommand(t *testing.T) {
+	config := &AgentConfig{
+		UserParameters: []*UserParameter{
+			{Key: "mysql.ping", Command: "mysqladmin ping"},
+			{Key: "pgsql.query", Flexible: true, Command: "psql -h $1 -p $2 -c '$3' # $$1"},
+		},
+	}
+
+	tests := []struct {
+		key     string
+		command string
+		ok      bool
+	}{
+		{"mysql.ping", "mysqladmin ping", true},
+		{"mysql.ping[localhost]", "", false},
+		{"pgsql.query[db1,5432,select 1]", "psql -h db1 -p 5432 -c 'select 1' # $db1", true},
+		{"pgsql.query[db1]", "psql -h db1 -p  -c '' # $db1", true},
+		{"agent.ping", "", false},
+	}
+
+	for _, test := range tests {
+		command, ok, err := config.Command(test.key)
+		if ok != test.ok || command != test.command || err != nil {
+			t.Errorf("Expected %q (%v) for %s; got %q (%v, %v)", test.command, test.ok, test.key, command, ok, err)
+		}
+	}
+
+	// special characters in parameters are unsupported unless allowed
+	for _, key := range []string{`pgsql.query[db1,5432,"select 1; drop table x"]`, "pgsql.query[$(reboot)]", "pgsql.query[\"a\nb\"]"} {
+		if _, ok, err := config.Command(key); !ok || err == nil {
+			t.Errorf("Expected unsafe parameters to be rejected for %s", key)
+		}
+	}
+	direct := NewDirectTest(config)
+	if result := direct.Run("pgsql.query[`id`]", time.Second); !result.Unsupported() {
+		t.Errorf("Expected unsupported result for unsafe parameters; got %q", result.Value)
+	}
+
+	dir, err := ioutil.TempDir("", APP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "zabbix_agentd.conf")
+	if err := ioutil.WriteFile(path, []byte("UnsafeUserParameters=1\nUserParameter=echo[*],echo $1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err = LoadAgentConfig(path)
+	if err != nil {
+		t.Fatalf("Error loading agent config: %v", err)
+	}
+	if command, _, err := config.Command("echo[$HOME]"); err != nil || command != "echo $HOME" {
+		t.Errorf("Expected unsafe parameters to be allowed; got %q (%v)", command, err)
+	}
+
+	if !IsLocalHost("127.0.0.1:10050") || IsLocalHost("192.0.2.1") {
+		t.Errorf("Incorrectly identified local host")
+	}
+
+	result := RunCommand("echo $((1 + 2)); echo; exit 1", time.Second)
+	if result.Err != nil || result.Value != "3" {
+		t.Errorf("Expected value 3 from command; got %q (%v)", result.Value, result.Err)
+	}
+}
+
+func TestColorize(t *testing.T) {
+	text := `system.run[echo "[red]100%"]`
+	if s := colorize("yellow", text); !strings.Contains(s, text) {
+		t.Errorf("Expected %q to be kept verbatim; got %q", text, s)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// metricsPrefix is prepended to the name of every exported metric.
+const metricsPrefix = "zabbix_agent_bench_"
+
+// inFlight is the number of requests currently awaiting a response from the
+// agent. It must only be accessed atomically.
+var inFlight int64
+
+// StartMetricsServer starts serving the stats of all goroutines registered
+// with the given monitor in the Prometheus text format at /metrics on the
+// given address.
+func StartMetricsServer(addr string, m *Monitor, pool *ConsumerPool) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return NewError(err, "Failed to listen for metrics requests on %s", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w, m.Snapshot(), atomic.LoadInt64(&inFlight), threadCount, pool.Size())
+	})
+
+	dprintf("Serving metrics on http://%s/metrics\n", l.Addr())
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !stop {
+			PrintWarning(NewError(err, "Metrics server stopped"))
+		}
+	}()
+
+	return nil
+}
+
+// WriteMetrics writes the given stats in the Prometheus text exposition
+// format.
+func WriteMetrics(w io.Writer, stats *ThreadStats, inFlight int64, threads, running int) error {
+	b := bufio.NewWriter(w)
+
+	keys := make([]string, 0, len(stats.KeyStats))
+	for key := range stats.KeyStats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// requests by key and result
+	writeMetricHeader(b, "requests_total", "counter", "Requests made to the agent by key and result.")
+	for _, key := range keys {
+		keyStats := stats.KeyStats[key]
+		for _, r := range []struct {
+			result string
+			count  int64
+		}{
+			{"success", keyStats.Success},
+			{"unsupported", keyStats.NotSupported},
+			{"error", keyStats.Error},
+		} {
+			fmt.Fprintf(b, "%srequests_total{key=\"%s\",result=\"%s\"} %d\n", metricsPrefix, escapeLabel(key), r.result, r.count)
+		}
+	}
+
+	writeMetricHeader(b, "retries_total", "counter", "Retried requests by key.")
+	for _, key := range keys {
+		fmt.Fprintf(b, "%sretries_total{key=\"%s\"} %d\n", metricsPrefix, escapeLabel(key), stats.KeyStats[key].Retries)
+	}
+
+	// latency of all requests in the buckets of LatencyHistogram
+	writeMetricHeader(b, "request_duration_seconds", "histogram", "Latency of all requests.")
+	cumulative := int64(0)
+	for i, bound := range latencyBuckets {
+		cumulative += stats.Latency.Buckets[i]
+		fmt.Fprintf(b, "%srequest_duration_seconds_bucket{le=\"%s\"} %d\n", metricsPrefix, strconv.FormatFloat(bound.Seconds(), 'g', 6, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%srequest_duration_seconds_bucket{le=\"+Inf\"} %d\n", metricsPrefix, stats.Latency.Count)
+	fmt.Fprintf(b, "%srequest_duration_seconds_sum %s\n", metricsPrefix, formatMetric(stats.Latency.Sum.Seconds()))
+	fmt.Fprintf(b, "%srequest_duration_seconds_count %d\n", metricsPrefix, stats.Latency.Count)
+
+	// per key latency is summarised to keep the number of series down
+	writeMetricHeader(b, "key_duration_seconds", "summary", "Latency of requests by key.")
+	for _, key := range keys {
+		h := stats.KeyStats[key].Latency
+		label := escapeLabel(key)
+		for _, q := range []float64{0.5, 0.95, 0.99} {
+			fmt.Fprintf(b, "%skey_duration_seconds{key=\"%s\",quantile=\"%s\"} %s\n", metricsPrefix, label, formatMetric(q), formatMetric(h.Percentile(q*100).Seconds()))
+		}
+		fmt.Fprintf(b, "%skey_duration_seconds_sum{key=\"%s\"} %s\n", metricsPrefix, label, formatMetric(h.Sum.Seconds()))
+		fmt.Fprintf(b, "%skey_duration_seconds_count{key=\"%s\"} %d\n", metricsPrefix, label, h.Count)
+	}
+
+	writeMetricHeader(b, "in_flight_requests", "gauge", "Requests awaiting a response from the agent.")
+	fmt.Fprintf(b, "%sin_flight_requests %d\n", metricsPrefix, inFlight)
+
+	writeMetricHeader(b, "threads", "gauge", "Configured number of test threads.")
+	fmt.Fprintf(b, "%sthreads %d\n", metricsPrefix, threads)
+
+	writeMetricHeader(b, "running_threads", "gauge", "Number of test threads currently running.")
+	fmt.Fprintf(b, "%srunning_threads %d\n", metricsPrefix, running)
+
+	return b.Flush()
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, typ)
+}
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func formatMetric(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,80 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"sync"
+)
+
+// A ConsumerPool runs a variable number of consumer goroutines which read
+// from the same producer channel. Each consumer submits its stats to the
+// stats channel when it exits, whether because the producer was closed or
+// because the pool was shrunk.
+type ConsumerPool struct {
+	mu        sync.Mutex
+	producer  <-chan *Check
+	statsChan chan *ThreadStats
+	quit      []chan bool
+	started   int
+}
+
+// NewConsumerPool returns an empty ConsumerPool for the given producer.
+func NewConsumerPool(producer <-chan *Check, statsChan chan *ThreadStats) *ConsumerPool {
+	return &ConsumerPool{
+		producer:  producer,
+		statsChan: statsChan,
+		quit:      make([]chan bool, 0),
+	}
+}
+
+// Resize starts or stops consumers until n consumers are running.
+func (c *ConsumerPool) Resize(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.quit) < n {
+		quit := make(chan bool)
+		c.quit = append(c.quit, quit)
+		c.started++
+
+		dprintf("Starting thread %d...\n", len(c.quit))
+		go StartConsumer(c.producer, quit, c.statsChan)
+	}
+
+	for len(c.quit) > n && len(c.quit) > 0 {
+		dprintf("Stopping thread %d...\n", len(c.quit))
+		close(c.quit[len(c.quit)-1])
+		c.quit = c.quit[:len(c.quit)-1]
+	}
+}
+
+// Size returns the number of running consumers.
+func (c *ConsumerPool) Size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.quit)
+}
+
+// Started returns the number of consumers started since the pool was created,
+// which is the number of stats each consumer will submit to the stats channel.
+func (c *ConsumerPool) Started() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.started
+}
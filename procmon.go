@@ -0,0 +1,370 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"github.com/mitchellh/colorstring"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resource trend verdicts
+const (
+	VerdictStable   = "stable"
+	VerdictLeak     = "leak suspected"
+	VerdictTooShort = "too few samples"
+)
+
+const (
+	// minLeakSamples is the fewest samples from which a leak is suspected.
+	minLeakSamples = 10
+
+	// leakGrowth is the growth of a resource over a run, as a fraction of
+	// its starting value, above which a steady increase is a suspected leak.
+	leakGrowth = 0.05
+
+	// leakFit is the coefficient of determination of a linear fit above
+	// which growth is considered steady rather than noise.
+	leakFit = 0.6
+)
+
+// A ProcessSample holds the resources used by a process and its descendants
+// at a point in time.
+type ProcessSample struct {
+	Time      time.Time
+	PID       int
+	Processes int64
+	Threads   int64
+	FDs       int64
+	RSS       int64
+	CPU       time.Duration
+}
+
+// A ProcessMonitor periodically samples the resources used by the agent
+// process tree, given either by PID or by a PID file which is read before each
+// sample so that the agent may be restarted.
+type ProcessMonitor struct {
+	mu       sync.Mutex
+	PID      int
+	PIDFile  string
+	interval time.Duration
+	samples  []*ProcessSample
+	restarts int
+	errors   int
+	lastErr  error
+	quit     chan bool
+	done     chan bool
+}
+
+// NewProcessMonitor returns a ProcessMonitor for the given PID or PID file.
+func NewProcessMonitor(pid int, pidFile string, interval time.Duration) *ProcessMonitor {
+	return &ProcessMonitor{
+		PID:      pid,
+		PIDFile:  pidFile,
+		interval: interval,
+		samples:  make([]*ProcessSample, 0),
+		quit:     make(chan bool),
+		done:     make(chan bool),
+	}
+}
+
+// ReadPIDFile returns the process ID stored in a PID file.
+func ReadPIDFile(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, NewError(err, "Failed to read PID file")
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, NewError(err, "Invalid PID in %s", path)
+	}
+
+	return pid, nil
+}
+
+// Sample returns a sample of the process tree without recording it.
+func (c *ProcessMonitor) Sample() (*ProcessSample, error) {
+	pid := c.PID
+	if c.PIDFile != "" {
+		var err error
+		if pid, err = ReadPIDFile(c.PIDFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return SampleProcess(pid)
+}
+
+// sample takes and records a single sample of the process tree.
+func (c *ProcessMonitor) sample() error {
+	sample, err := c.Sample()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n := len(c.samples); n > 0 && c.samples[n-1].PID != sample.PID {
+		dprintf("Agent PID changed from %d to %d\n", c.samples[n-1].PID, sample.PID)
+		c.restarts++
+	}
+	c.samples = append(c.samples, sample)
+
+	return nil
+}
+
+// Start takes a first sample, returning any error, and then starts a
+// goroutine which samples the process tree every interval until Stop is
+// called.
+func (c *ProcessMonitor) Start() error {
+	if err := c.sample(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		defer close(c.done)
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.sample(); err != nil {
+					dprintf("Failed to sample agent process: %v\n", err)
+					c.mu.Lock()
+					c.errors++
+					c.lastErr = err
+					c.mu.Unlock()
+				}
+
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops sampling after taking a final sample.
+func (c *ProcessMonitor) Stop() {
+	close(c.quit)
+	<-c.done
+	c.sample()
+}
+
+// Samples returns all samples taken.
+func (c *ProcessMonitor) Samples() []*ProcessSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.samples
+}
+
+// LastProcessSamples returns the samples taken since the last change of PID,
+// which are those of the agent process as it was at the end of a run.
+func LastProcessSamples(samples []*ProcessSample) []*ProcessSample {
+	i := len(samples)
+	for i > 0 && samples[i-1].PID == samples[len(samples)-1].PID {
+		i--
+	}
+
+	return samples[i:]
+}
+
+// Restarts returns the number of times the PID of the agent changed.
+func (c *ProcessMonitor) Restarts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.restarts
+}
+
+// A ResourceTrend describes the change in a resource used by the agent over
+// a run.
+type ResourceTrend struct {
+	Name    string
+	Start   float64
+	End     float64
+	Min     float64
+	Max     float64
+	Slope   float64 // change per hour
+	Fit     float64 // coefficient of determination of the slope
+	Verdict string
+	format  func(float64) string
+}
+
+// Leak returns true if a leak of the resource is suspected.
+func (c ResourceTrend) Leak() bool {
+	return c.Verdict == VerdictLeak
+}
+
+// Format formats a value of the resource.
+func (c ResourceTrend) Format(f float64) string {
+	if c.format == nil {
+		return fmt.Sprintf("%.0f", f)
+	}
+
+	return c.format(f)
+}
+
+// LinearRegression returns the least squares slope of y over x and its
+// coefficient of determination.
+func LinearRegression(x, y []float64) (slope, r2 float64) {
+	n := float64(len(x))
+	if len(x) < 2 {
+		return 0, 0
+	}
+
+	var sumX, sumY float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var sxx, sxy, syy float64
+	for i := range x {
+		dx, dy := x[i]-meanX, y[i]-meanY
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+
+	if sxx == 0 {
+		return 0, 0
+	}
+	slope = sxy / sxx
+
+	if syy == 0 {
+		return slope, 1
+	}
+
+	return slope, (sxy * sxy) / (sxx * syy)
+}
+
+// NewResourceTrend returns the trend of a resource from the given samples.
+// A leak is suspected if the resource grew steadily by more than leakGrowth
+// of its starting value over the samples.
+func NewResourceTrend(name string, samples []*ProcessSample, value func(*ProcessSample) float64, format func(float64) string) ResourceTrend {
+	trend := ResourceTrend{Name: name, Verdict: VerdictTooShort, format: format}
+	if len(samples) == 0 {
+		return trend
+	}
+
+	x := make([]float64, len(samples))
+	y := make([]float64, len(samples))
+	for i, sample := range samples {
+		x[i] = sample.Time.Sub(samples[0].Time).Hours()
+		y[i] = value(sample)
+
+		if i == 0 || y[i] < trend.Min {
+			trend.Min = y[i]
+		}
+		if y[i] > trend.Max {
+			trend.Max = y[i]
+		}
+	}
+	trend.Start, trend.End = y[0], y[len(y)-1]
+	trend.Slope, trend.Fit = LinearRegression(x, y)
+
+	if len(samples) < minLeakSamples {
+		return trend
+	}
+
+	trend.Verdict = VerdictStable
+	growth := trend.Slope * x[len(x)-1]
+	base := trend.Start
+	if base < 1 {
+		base = 1
+	}
+	if growth > leakGrowth*base && trend.Fit >= leakFit {
+		trend.Verdict = VerdictLeak
+	}
+
+	return trend
+}
+
+// Trends returns the trends of the memory, file descriptors, threads and
+// processes used by the agent since it was last restarted, as the resources
+// of a new process are unrelated to those of the last.
+func (c *ProcessMonitor) Trends() []ResourceTrend {
+	samples := LastProcessSamples(c.Samples())
+	count := func(f float64) string {
+		return strconv.FormatFloat(math.Floor(f*10+0.5)/10, 'f', -1, 64)
+	}
+	mib := func(f float64) string {
+		return fmt.Sprintf("%.1fMiB", f/(1<<20))
+	}
+
+	return []ResourceTrend{
+		NewResourceTrend("RSS", samples, func(s *ProcessSample) float64 { return float64(s.RSS) }, mib),
+		NewResourceTrend("Open files", samples, func(s *ProcessSample) float64 { return float64(s.FDs) }, count),
+		NewResourceTrend("Threads", samples, func(s *ProcessSample) float64 { return float64(s.Threads) }, count),
+		NewResourceTrend("Processes", samples, func(s *ProcessSample) float64 { return float64(s.Processes) }, count),
+	}
+}
+
+// Print prints the trend of each resource used by the agent and returns the
+// number of suspected leaks.
+func (c *ProcessMonitor) Print() int {
+	samples := LastProcessSamples(c.Samples())
+	if len(samples) == 0 {
+		return 0
+	}
+
+	first, last := samples[0], samples[len(samples)-1]
+	elapsed := last.Time.Sub(first.Time)
+
+	fmt.Printf("\n=== Agent resources ===\n\n")
+	fmt.Printf("PID %d, %d samples over %s\n", last.PID, len(samples), elapsed/time.Second*time.Second)
+	if elapsed > 0 && last.CPU >= first.CPU {
+		fmt.Printf("CPU time %s (%.1f%% of one CPU)\n", last.CPU-first.CPU, 100*float64(last.CPU-first.CPU)/float64(elapsed))
+	}
+	if c.restarts > 0 {
+		colorstring.Printf("[yellow]Agent restarted %d times[default]; trends are of PID %d since the last restart only\n", c.restarts, last.PID)
+	}
+	if c.errors > 0 {
+		colorstring.Printf("[yellow]%d samples failed[default] (last error: %v)\n", c.errors, c.lastErr)
+	}
+
+	fmt.Printf("\n%-10s  \tstart\t\tend\t\tmin\t\tmax\t\tper hour\tverdict\n", "resource")
+	leaks := 0
+	for _, trend := range c.Trends() {
+		color := "default"
+		if trend.Leak() {
+			color = "red"
+			leaks++
+		}
+
+		perHour := trend.Format(trend.Slope)
+		if trend.Slope >= 0 {
+			perHour = "+" + perHour
+		}
+
+		fmt.Printf("%-10s :\t%-10s\t%-10s\t%-10s\t%-10s\t%-10s\t%s\n", trend.Name, trend.Format(trend.Start), trend.Format(trend.End), trend.Format(trend.Min), trend.Format(trend.Max), perHour, colorize(color, trend.Verdict))
+	}
+
+	return leaks
+}
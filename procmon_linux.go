@@ -0,0 +1,137 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the number of clock ticks per second in which CPU time is
+// given in /proc. It is 100 on all common Linux platforms.
+const clockTicks = 100
+
+// procStat holds the fields of /proc/<pid>/stat used to sample a process.
+type procStat struct {
+	ppid    int
+	cpu     time.Duration
+	threads int64
+	rss     int64
+}
+
+// readProcStat reads /proc/<pid>/stat.
+func readProcStat(pid int) (*procStat, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// the command name may contain spaces and parentheses, so fields are
+	// counted from the last parenthesis
+	s := string(b)
+	i := strings.LastIndex(s, ")")
+	if i < 0 {
+		return nil, NewError(nil, "Invalid stat for process %d", pid)
+	}
+
+	fields := strings.Fields(s[i+1:])
+	if len(fields) < 22 {
+		return nil, NewError(nil, "Invalid stat for process %d", pid)
+	}
+
+	parse := func(i int) int64 {
+		n, _ := strconv.ParseInt(fields[i], 10, 64)
+		return n
+	}
+
+	return &procStat{
+		ppid:    int(parse(1)),
+		cpu:     time.Duration(parse(11)+parse(12)) * time.Second / clockTicks,
+		threads: parse(17),
+		rss:     parse(21) * int64(os.Getpagesize()),
+	}, nil
+}
+
+// processTree returns the given process and all of its descendants.
+func processTree(pid int) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// processes may exit while /proc is read
+		stat, err := readProcStat(child)
+		if err != nil {
+			continue
+		}
+		children[stat.ppid] = append(children[stat.ppid], child)
+	}
+
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+
+	return tree, nil
+}
+
+// SampleProcess returns the sum of resources used by a process and all of
+// its descendants.
+func SampleProcess(pid int) (*ProcessSample, error) {
+	if _, err := readProcStat(pid); err != nil {
+		return nil, NewError(err, "Failed to read process %d", pid)
+	}
+
+	tree, err := processTree(pid)
+	if err != nil {
+		return nil, NewError(err, "Failed to read process tree of %d", pid)
+	}
+
+	sample := &ProcessSample{
+		Time: time.Now(),
+		PID:  pid,
+	}
+
+	for _, p := range tree {
+		stat, err := readProcStat(p)
+		if err != nil {
+			continue
+		}
+
+		sample.Processes++
+		sample.RSS += stat.rss
+		sample.Threads += stat.threads
+		sample.CPU += stat.cpu
+
+		if fds, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/fd", p)); err == nil {
+			sample.FDs += int64(len(fds))
+		}
+	}
+
+	return sample, nil
+}
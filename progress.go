@@ -0,0 +1,125 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A Monitor gives access to the live stats of every running producer and
+// consumer goroutine while a test is in progress.
+type Monitor struct {
+	mu      sync.Mutex
+	start   time.Time
+	threads []*ThreadStats
+}
+
+// NewMonitor returns a new Monitor.
+func NewMonitor() *Monitor {
+	return &Monitor{
+		start:   time.Now(),
+		threads: make([]*ThreadStats, 0),
+	}
+}
+
+// Start resets the start time of the test.
+func (c *Monitor) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.start = time.Now()
+}
+
+// Elapsed returns the time since the test started.
+func (c *Monitor) Elapsed() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return time.Now().Sub(c.start)
+}
+
+// Register adds the stats of a goroutine to the monitor. The goroutine must
+// hold the lock of its stats while updating them.
+func (c *Monitor) Register(stats *ThreadStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.threads = append(c.threads, stats)
+}
+
+// Snapshot returns the sum of the current stats of all registered goroutines.
+func (c *Monitor) Snapshot() *ThreadStats {
+	c.mu.Lock()
+	threads := c.threads
+	c.mu.Unlock()
+
+	totals := NewThreadStats()
+	for _, stats := range threads {
+		stats.Lock()
+		totals.Add(stats)
+		stats.Unlock()
+	}
+
+	return totals
+}
+
+// StartProgress starts a goroutine which prints a status line with rolling
+// statistics every interval until the test is stopped. The status includes
+// the throughput, error rate and 99th percentile latency since the previous
+// status line and the time remaining until the time limit, or an estimate of
+// the time remaining until the given number of expected values is reached.
+func StartProgress(m *Monitor, interval time.Duration, timeLimit time.Duration, expected int64) {
+	go func() {
+		prev := NewThreadStats()
+		last := m.Elapsed()
+		for {
+			time.Sleep(interval)
+			if stop {
+				return
+			}
+
+			elapsed := m.Elapsed()
+			stats := m.Snapshot()
+			delta := stats.Delta(prev)
+			fmt.Println(formatProgress(delta, elapsed, elapsed-last, timeLimit, expected, stats.TotalValues+stats.ErrorCount))
+			prev, last = stats, elapsed
+		}
+	}()
+}
+
+// formatProgress returns a status line for the given interval stats.
+func formatProgress(delta *ThreadStats, elapsed, interval, timeLimit time.Duration, expected, done int64) string {
+	polls := delta.TotalValues + delta.ErrorCount
+	nvps := float64(delta.TotalValues) / interval.Seconds()
+
+	remaining := "unlimited"
+	switch {
+	case timeLimit > 0:
+		remaining = ((timeLimit - elapsed) / time.Second * time.Second).String()
+	case expected > 0 && done > 0:
+		remaining = (time.Duration(float64(elapsed)*float64(expected-done)/float64(done)) / time.Second * time.Second).String()
+	}
+
+	return fmt.Sprintf("[%s elapsed, %s remaining] %.2f NVPS, %.2f%% errors, p99 %s",
+		elapsed/time.Second*time.Second,
+		remaining,
+		nvps,
+		percent(delta.ErrorCount, polls),
+		formatLatency(delta.Latency.Percentile(99)))
+}
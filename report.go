@@ -0,0 +1,450 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Report formats
+const (
+	ReportHTML = "html"
+	ReportJSON = "json"
+)
+
+// A RunReport holds the configuration and results of a finished run for
+// writing to a report file. Reports saved as JSON may be loaded again to
+// compare runs.
+type RunReport struct {
+	Version           string
+	CommandLine       string
+	Settings          []ReportSetting
+	Host              string
+	Start             time.Time
+	Duration          time.Duration
+	Threads           int
+	Totals            *ThreadStats
+	Keys              []*KeyReport
+	History           []*SeriesPoint
+	DiscoveryFailures []string
+	Outages           []Outage
+	Resources         []ResourceTrend
+	AgentRestarts     int
+	Hooks             []*HookResult
+}
+
+// A ReportSetting is a command line flag given for a run.
+type ReportSetting struct {
+	Name  string
+	Value string
+}
+
+// A KeyReport holds the results of a single key in a RunReport.
+type KeyReport struct {
+	Key     string
+	Origins string
+	Timeout time.Duration
+	AtRisk  bool
+	Stats   KeyStats
+	Log     []string
+	Direct  *DirectKeyStats
+}
+
+// NewKeyReport returns the report of a key with the given stats. The key is at
+// risk of timing out if its 95th percentile latency is at or above the given
+// fraction of the agent's timeout. The agent abandons a check after its own
+// Timeout, so the timeout of the key, which is only the deadline of this
+// client, is not used.
+func NewKeyReport(key *ItemKey, stats KeyStats, agentTimeout time.Duration, warn float64) *KeyReport {
+	c := &KeyReport{
+		Key:     key.Key,
+		Origins: key.OriginString(),
+		Timeout: agentTimeout,
+		Stats:   stats,
+	}
+	c.AtRisk = stats.Latency.Percentile(95) >= time.Duration(warn*float64(agentTimeout))
+
+	return c
+}
+
+// FailureRate returns the percentage of checks of the key which were
+// unsupported or failed.
+func (c *KeyReport) FailureRate() float64 {
+	return percent(c.Stats.NotSupported+c.Stats.Error, c.Stats.Polls())
+}
+
+// ReportSettings returns every command line flag which was set for the run.
+func ReportSettings() []ReportSetting {
+	settings := make([]ReportSetting, 0)
+	flag.Visit(func(f *flag.Flag) {
+		settings = append(settings, ReportSetting{f.Name, f.Value.String()})
+	})
+
+	return settings
+}
+
+// Failures returns the reports of all keys which failed at least once.
+func (c *RunReport) Failures() []*KeyReport {
+	failures := make([]*KeyReport, 0)
+	for _, key := range c.Keys {
+		if key.Stats.NotSupported+key.Stats.Error > 0 {
+			failures = append(failures, key)
+		}
+	}
+
+	return failures
+}
+
+// DirectKeys returns the reports of all UserParameter keys which were also run
+// directly.
+func (c *RunReport) DirectKeys() []*KeyReport {
+	keys := make([]*KeyReport, 0)
+	for _, key := range c.Keys {
+		if key.Direct != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// AgentLog returns true if agent log lines are attached to any key.
+func (c *RunReport) AgentLog() bool {
+	for _, key := range c.Keys {
+		if len(key.Log) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NVPS returns the mean number of values processed per second.
+func (c *RunReport) NVPS() float64 {
+	return float64(c.Totals.TotalValues) / c.Duration.Seconds()
+}
+
+// WriteReport writes the report in the given format to a file.
+func (c *RunReport) WriteReport(path, format string) error {
+	var buf bytes.Buffer
+	switch format {
+	case ReportHTML:
+		if err := reportTemplate.Execute(&buf, c); err != nil {
+			return NewError(err, "Failed to render HTML report")
+		}
+
+	case ReportJSON:
+		b, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return NewError(err, "Failed to encode results")
+		}
+		buf.Write(b)
+
+	default:
+		return NewError(nil, "Unknown report format: %s", format)
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return NewError(err, "Failed to write report to %s", path)
+	}
+
+	return nil
+}
+
+// ReportPath returns the path of a report file in the given format, defaulting
+// to a file named after the application in the working directory.
+func ReportPath(path, format string) string {
+	if path != "" {
+		return path
+	}
+
+	return fmt.Sprintf("%s.%s", APP, format)
+}
+
+// chartPoints reduces values to at most n points by averaging adjacent values,
+// so that charts of long runs remain a reasonable size.
+func chartPoints(values []float64, n int) []float64 {
+	if len(values) <= n {
+		return values
+	}
+
+	points := make([]float64, n)
+	for i := range points {
+		from, to := i*len(values)/n, (i+1)*len(values)/n
+		sum := 0.0
+		for _, v := range values[from:to] {
+			sum += v
+		}
+		points[i] = sum / float64(to-from)
+	}
+
+	return points
+}
+
+// svgLineChart returns an inline SVG line chart of the given values, labelled
+// with the maximum value.
+func svgLineChart(values []float64, width, height int, color, unit string) template.HTML {
+	values = chartPoints(values, width)
+	max := 0.0
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg class="chart" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height+20, width, height+20)
+	fmt.Fprintf(&b, `<line x1="0" y1="%d" x2="%d" y2="%d" class="axis"/>`, height, width, height)
+	if len(values) > 1 && max > 0 {
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="`, color)
+		for i, v := range values {
+			x := float64(i) * float64(width-1) / float64(len(values)-1)
+			y := float64(height) - v/max*float64(height-4)
+			fmt.Fprintf(&b, "%.1f,%.1f ", x, y)
+		}
+		b.WriteString(`"/>`)
+	}
+	fmt.Fprintf(&b, `<text x="2" y="12">max %.2f%s</text>`, max, template.HTMLEscapeString(unit))
+	fmt.Fprintf(&b, `<text x="2" y="%d">0</text>`, height+14)
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String())
+}
+
+// svgHistogram returns an inline SVG bar chart of the non-empty range of
+// buckets in a latency histogram, labelled with the range of latencies shown.
+func svgHistogram(h LatencyHistogram, width, height int, labels bool) template.HTML {
+	first, last := -1, -1
+	max := int64(0)
+	for i, n := range h.Buckets {
+		if n > 0 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+		if n > max {
+			max = n
+		}
+	}
+
+	var b bytes.Buffer
+	textHeight := 0
+	if labels {
+		textHeight = 16
+	}
+	fmt.Fprintf(&b, `<svg class="chart" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height+textHeight, width, height+textHeight)
+	if first >= 0 {
+		barWidth := float64(width) / float64(last-first+1)
+		for i := first; i <= last; i++ {
+			barHeight := float64(h.Buckets[i]) / float64(max) * float64(height)
+			fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" class="bar"><title>%s: %d</title></rect>`,
+				float64(i-first)*barWidth, float64(height)-barHeight, barWidth*0.9, barHeight, bucketLabel(i), h.Buckets[i])
+		}
+
+		if labels {
+			fmt.Fprintf(&b, `<text x="0" y="%d">%s</text>`, height+13, bucketLabel(first))
+			fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, width, height+13, bucketLabel(last))
+		}
+	}
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String())
+}
+
+// bucketLabel describes the upper bound of a latency histogram bucket.
+func bucketLabel(i int) string {
+	if i >= len(latencyBuckets) {
+		return fmt.Sprintf("&gt;%s", formatLatency(latencyBuckets[len(latencyBuckets)-1]))
+	}
+
+	return fmt.Sprintf("&le;%s", formatLatency(latencyBuckets[i]))
+}
+
+var reportFuncs = template.FuncMap{
+	"latency": formatLatency,
+	"p": func(h LatencyHistogram, p float64) string {
+		return formatLatency(h.Percentile(p))
+	},
+	"rate": func(n int64, d time.Duration) string {
+		return fmt.Sprintf("%.3f", float64(n)/d.Seconds())
+	},
+	"histogram": svgHistogram,
+	"throughputChart": func(points []*SeriesPoint) template.HTML {
+		values := make([]float64, len(points))
+		for i, point := range points {
+			values[i] = point.Rate
+		}
+		return svgLineChart(values, 800, 160, "#2a7ae2", " NVPS")
+	},
+	"failureChart": func(points []*SeriesPoint) template.HTML {
+		values := make([]float64, len(points))
+		for i, point := range points {
+			if point.Requests > 0 {
+				values[i] = percent(point.Unsupported+point.Errors, point.Requests)
+			}
+		}
+		return svgLineChart(values, 800, 100, "#d9534f", "% failed")
+	},
+	"latencyChart": func(points []*SeriesPoint) template.HTML {
+		values := make([]float64, len(points))
+		for i, point := range points {
+			values[i] = point.P99Ms
+		}
+		return svgLineChart(values, 800, 120, "#8e44ad", "ms p99")
+	},
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "end of run"
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"round": func(d time.Duration) time.Duration {
+		return d / time.Millisecond * time.Millisecond
+	},
+	"printable": func(s string) string {
+		return strings.Replace(s, "\x00", `\0`, -1)
+	},
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Host}} - zabbix_agent_bench report</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 2em; color: #222; }
+h1 { font-size: 22px; }
+h2 { font-size: 18px; margin-top: 2em; border-bottom: 1px solid #ccc; }
+h3 { font-size: 14px; }
+table { border-collapse: collapse; }
+th, td { padding: 3px 10px; text-align: left; vertical-align: middle; }
+th { background: #f0f0f0; }
+tr:nth-child(even) td { background: #fafafa; }
+td.n { text-align: right; font-family: monospace; }
+td.key, td.msg { font-family: monospace; }
+.ok { color: #3c763d; } .warn { color: #b8860b; } .err { color: #d9534f; }
+.chart text { font-size: 11px; fill: #666; }
+.chart .axis { stroke: #ccc; }
+.chart .bar { fill: #2a7ae2; }
+pre { margin: 0; max-height: 20em; overflow: auto; font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>Zabbix agent benchmark of {{.Host}}</h1>
+<p>Started {{time .Start}}, ran for {{round .Duration}} with {{.Threads}} threads using zabbix_agent_bench {{.Version}}.</p>
+
+<h2>Configuration</h2>
+<p><code>{{.CommandLine}}</code></p>
+{{if .Settings}}<table>
+<tr><th>Flag</th><th>Value</th></tr>
+{{range .Settings}}<tr><td>-{{.Name}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>{{end}}
+
+<h2>Totals</h2>
+<table>
+<tr><td>Values processed</td><td class="n">{{.Totals.TotalValues}}</td></tr>
+<tr><td>Unsupported values</td><td class="n warn">{{.Totals.UnsupportedValues}}</td></tr>
+<tr><td>Transport errors</td><td class="n err">{{.Totals.ErrorCount}}</td></tr>
+<tr><td>Key list iterations</td><td class="n">{{.Totals.Iterations}}</td></tr>
+<tr><td>Retries</td><td class="n">{{.Totals.RetryCount}}</td></tr>
+<tr><td>Values per second</td><td class="n">{{printf "%.2f" .NVPS}}</td></tr>
+<tr><td>Latency mean / p50 / p95 / p99 / max</td><td class="n">{{latency .Totals.Latency.Mean}} / {{p .Totals.Latency 50}} / {{p .Totals.Latency 95}} / {{p .Totals.Latency 99}} / {{latency .Totals.Latency.Max}}</td></tr>
+<tr><td>Failed discovery rules</td><td class="n">{{len .DiscoveryFailures}}</td></tr>
+<tr><td>Agent outages</td><td class="n">{{len .Outages}}</td></tr>
+</table>
+
+<h2>Latency distribution</h2>
+{{histogram .Totals.Latency 800 160 true}}
+
+{{if .History}}<h2>Throughput over time</h2>
+{{throughputChart .History}}
+<h2>Failure rate over time</h2>
+{{failureChart .History}}
+<h2>Latency over time</h2>
+{{latencyChart .History}}{{end}}
+
+<h2>Keys</h2>
+<table>
+<tr><th>Key</th><th>Success</th><th>Unsupported</th><th>Errors</th><th>Rate/s</th><th>p50</th><th>p95</th><th>p99</th><th>Max</th><th>Timeout</th><th>Distribution</th></tr>
+{{$d := .Duration}}{{range .Keys}}<tr>
+<td class="key" title="{{.Origins}}">{{.Key}}</td>
+<td class="n ok">{{.Stats.Success}}</td>
+<td class="n warn">{{.Stats.NotSupported}}</td>
+<td class="n err">{{.Stats.Error}}</td>
+<td class="n">{{rate .Stats.Polls $d}}</td>
+<td class="n">{{p .Stats.Latency 50}}</td>
+<td class="n">{{p .Stats.Latency 95}}</td>
+<td class="n">{{p .Stats.Latency 99}}</td>
+<td class="n">{{latency .Stats.Latency.Max}}</td>
+<td class="n{{if .AtRisk}} warn{{end}}">{{.Timeout}}</td>
+<td>{{histogram .Stats.Latency 120 20 false}}</td>
+</tr>
+{{end}}</table>
+
+{{with .Failures}}<h2>Failing keys</h2>
+<table>
+<tr><th>Key</th><th>Failed</th><th>Last failure</th></tr>
+{{range .}}<tr><td class="key">{{.Key}}</td><td class="n">{{printf "%.2f%%" .FailureRate}}</td><td class="msg">{{printable .Stats.LastFailure}}</td></tr>
+{{end}}</table>{{end}}
+
+{{with .DirectKeys}}<h2>UserParameter overhead</h2>
+<table>
+<tr><th>Key</th><th>Agent p50</th><th>Direct p50</th><th>Overhead p50</th><th>Agent p95</th><th>Direct p95</th><th>Overhead p95</th><th>Value differences</th></tr>
+{{range .}}<tr><td class="key">{{.Key}}</td><td class="n">{{p .Direct.Agent.Latency 50}}</td><td class="n">{{p .Direct.Direct.Latency 50}}</td><td class="n">{{latency (.Direct.Overhead 50)}}</td><td class="n">{{p .Direct.Agent.Latency 95}}</td><td class="n">{{p .Direct.Direct.Latency 95}}</td><td class="n">{{latency (.Direct.Overhead 95)}}</td><td class="n{{if .Direct.ValueDiffs}} warn{{end}}">{{.Direct.ValueDiffs}}</td></tr>
+{{end}}</table>{{end}}
+
+{{if .AgentLog}}<h2>Agent log</h2>
+{{range .Keys}}{{if .Log}}<h3 class="key">{{.Key}}</h3>
+<pre>{{range .Log}}{{.}}
+{{end}}</pre>
+{{end}}{{end}}{{end}}
+
+{{with .DiscoveryFailures}}<h2>Failed discovery rules</h2>
+<ul>
+{{range .}}<li><code>{{.}}</code></li>
+{{end}}</ul>{{end}}
+
+{{with .Resources}}<h2>Agent resources</h2>
+{{if $.AgentRestarts}}<p>The agent restarted {{$.AgentRestarts}} times; trends are of the last process only.</p>
+{{end}}<table>
+<tr><th>Resource</th><th>Start</th><th>End</th><th>Min</th><th>Max</th><th>Per hour</th><th>Verdict</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td class="n">{{.Format .Start}}</td><td class="n">{{.Format .End}}</td><td class="n">{{.Format .Min}}</td><td class="n">{{.Format .Max}}</td><td class="n">{{.Format .Slope}}</td><td{{if .Leak}} class="err"{{end}}>{{.Verdict}}</td></tr>
+{{end}}</table>{{end}}
+
+{{with .Hooks}}<h2>Hooks</h2>
+<table>
+<tr><th>Hook</th><th>Stage</th><th>Command</th><th>Start</th><th>Duration</th><th>Result</th></tr>
+{{range .}}<tr><td>{{.Hook}}</td><td>{{.Stage}}</td><td class="key">{{.Command}}</td><td>{{time .Start}}</td><td>{{round .Duration}}</td><td{{if .Failed}} class="err"{{end}}>{{.Describe}}</td></tr>
+{{if .Output}}<tr><td colspan="6"><pre>{{.Output}}</pre></td></tr>
+{{end}}{{end}}</table>{{end}}
+
+{{with .Outages}}<h2>Agent outages</h2>
+<table>
+<tr><th>Start</th><th>End</th><th>Duration</th><th>Errors</th><th>Probes</th></tr>
+{{range .}}<tr><td>{{time .Start}}</td><td>{{time .End}}</td><td>{{round .Duration}}</td><td class="n">{{.Errors}}</td><td class="n">{{.Probes}}</td></tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))
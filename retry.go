@@ -0,0 +1,85 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// A RetryPolicy describes how failed requests are retried.
+type RetryPolicy struct {
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Classes    map[string]bool
+}
+
+// NewRetryPolicy returns a RetryPolicy which retries errors of the given comma
+// separated error classes, or all errors if classes is 'all'.
+func NewRetryPolicy(maxRetries int, backoff, maxBackoff time.Duration, classes string) (*RetryPolicy, error) {
+	policy := &RetryPolicy{
+		MaxRetries: maxRetries,
+		Backoff:    backoff,
+		MaxBackoff: maxBackoff,
+		Classes:    make(map[string]bool),
+	}
+
+	for _, class := range strings.Split(classes, ",") {
+		switch class = strings.TrimSpace(class); class {
+		case "all":
+			for _, c := range []string{ErrorClassRefused, ErrorClassReset, ErrorClassTimeout, ErrorClassEOF, ErrorClassOther} {
+				policy.Classes[c] = true
+			}
+
+		case ErrorClassRefused, ErrorClassReset, ErrorClassTimeout, ErrorClassEOF, ErrorClassOther:
+			policy.Classes[class] = true
+
+		default:
+			return nil, NewError(nil, "Unknown error class: %s", class)
+		}
+	}
+
+	return policy, nil
+}
+
+// ShouldRetry returns true if a request which failed with the given error on
+// the given attempt (starting at 1) should be retried.
+func (c *RetryPolicy) ShouldRetry(err error, attempt int) bool {
+	return c != nil && attempt <= c.MaxRetries && c.Classes[ErrorClass(err)]
+}
+
+// Delay returns the time to wait before retrying the given attempt (starting
+// at 1). The delay doubles with each attempt up to MaxBackoff and a random
+// jitter of up to half the delay is applied so that consumers do not retry in
+// lock step.
+func (c *RetryPolicy) Delay(attempt int, r *rand.Rand) time.Duration {
+	delay := c.Backoff
+	for i := 1; i < attempt && delay < c.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxBackoff {
+		delay = c.MaxBackoff
+	}
+
+	if half := int64(delay / 2); half > 0 {
+		return time.Duration(half + r.Int63n(half+1))
+	}
+
+	return delay
+}
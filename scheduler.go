@@ -0,0 +1,212 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// Key scheduling modes
+const (
+	ScheduleSequential = "sequential"
+	ScheduleWeighted   = "weighted"
+	ScheduleRandom     = "random"
+	SchedulePoller     = "poller"
+)
+
+// A Check is a request for a consumer to poll an item key, scheduled for a
+// point in time.
+type Check struct {
+	Key       *ItemKey
+	Scheduled time.Time
+}
+
+// A Scheduler returns the next key to be sent to a consumer.
+type Scheduler func() *ItemKey
+
+// NewScheduler returns a Scheduler for the given list of keys and scheduling
+// mode.
+//
+// The sequential scheduler returns each key in turn. The weighted scheduler
+// returns keys in proportion to their rate using a smooth weighted round
+// robin so that keys with the same rate are evenly spread. The random
+// scheduler picks keys at random with a probability proportional to their
+// rate.
+func NewScheduler(mode string, keys ItemKeys) (Scheduler, error) {
+	switch mode {
+	case ScheduleSequential:
+		i := -1
+		return func() *ItemKey {
+			i = (i + 1) % len(keys)
+			return keys[i]
+		}, nil
+
+	case ScheduleWeighted:
+		total := 0.0
+		for _, key := range keys {
+			total += key.Rate()
+		}
+
+		current := make([]float64, len(keys))
+		return func() *ItemKey {
+			next := 0
+			for i, key := range keys {
+				current[i] += key.Rate()
+				if current[i] > current[next] {
+					next = i
+				}
+			}
+			current[next] -= total
+
+			return keys[next]
+		}, nil
+
+	case ScheduleRandom:
+		cumulative := make([]float64, len(keys))
+		total := 0.0
+		for i, key := range keys {
+			total += key.Rate()
+			cumulative[i] = total
+		}
+
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		return func() *ItemKey {
+			n := r.Float64() * total
+			for i, c := range cumulative {
+				if n < c {
+					return keys[i]
+				}
+			}
+
+			return keys[len(keys)-1]
+		}, nil
+	}
+
+	return nil, NewError(nil, "Unknown schedule: %s", mode)
+}
+
+// checkQueue is a min-heap of checks ordered by their scheduled time.
+type checkQueue []*Check
+
+func (c checkQueue) Len() int            { return len(c) }
+func (c checkQueue) Less(i, j int) bool  { return c[i].Scheduled.Before(c[j].Scheduled) }
+func (c checkQueue) Swap(i, j int)       { c[i], c[j] = c[j], c[i] }
+func (c *checkQueue) Push(x interface{}) { *c = append(*c, x.(*Check)) }
+func (c *checkQueue) Pop() interface{} {
+	old := *c
+	check := old[len(old)-1]
+	*c = old[:len(old)-1]
+	return check
+}
+
+// StartPoller starts a goroutine which emulates the pollers of a Zabbix
+// server. Each key is published to the returned channel when it is due
+// according to its update interval, or the given default interval, until the
+// runtime limits are reached.
+//
+// Like the Zabbix server, keys with the same interval are spread across the
+// interval using an offset derived from the key, and the next check of a key
+// is calculated once its current check has been dispatched. Checks which could
+// not be dispatched before a key was next due are counted as missed.
+func StartPoller(keys ItemKeys, defaultInterval *UpdateInterval, jitter time.Duration, statsChan chan *ThreadStats) <-chan *Check {
+	c := make(chan *Check)
+	go func() {
+		stats := NewThreadStats()
+		monitor.Register(stats)
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+		// calculate the next check time of a key with random jitter
+		nextCheck := func(key *ItemKey, t time.Time) time.Time {
+			interval := key.Interval
+			if interval == nil {
+				interval = defaultInterval
+			}
+
+			h := fnv.New32a()
+			h.Write([]byte(key.Key))
+			next := interval.Next(t, time.Duration(h.Sum32())*time.Millisecond)
+			if !next.IsZero() && jitter > 0 {
+				next = next.Add(time.Duration(r.Int63n(int64(jitter))))
+			}
+
+			return next
+		}
+
+		queue := make(checkQueue, 0, len(keys))
+		now := time.Now()
+		for _, key := range keys {
+			if next := nextCheck(key, now); !next.IsZero() {
+				heap.Push(&queue, &Check{Key: key, Scheduled: next})
+			}
+		}
+
+		dispatched := 0
+		for !stop && len(queue) > 0 && (iterationLimit <= 0 || dispatched < iterationLimit*len(keys)) {
+
+			if isPaused() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			// wait for the next check to become due
+			check := queue[0]
+			if wait := check.Scheduled.Sub(time.Now()); wait > 0 {
+				if wait > 100*time.Millisecond {
+					wait = 100 * time.Millisecond
+				}
+				time.Sleep(wait)
+				continue
+			}
+
+			// send check to a consumer
+			heap.Pop(&queue)
+			c <- check
+			dispatched++
+
+			// reschedule and count polls missed while the pollers were busy
+			now := time.Now()
+			missed := int64(0)
+			next := nextCheck(check.Key, check.Scheduled)
+			for !next.IsZero() && next.Before(now) {
+				missed++
+				next = nextCheck(check.Key, next)
+			}
+
+			stats.Lock()
+			if dispatched%len(keys) == 0 {
+				stats.Iterations++
+			}
+			keyStats := stats.KeyStats[check.Key.Key]
+			keyStats.Missed += missed
+			stats.KeyStats[check.Key.Key] = keyStats
+			stats.MissedCount += missed
+			stats.Unlock()
+
+			if !next.IsZero() {
+				heap.Push(&queue, &Check{Key: check.Key, Scheduled: next})
+			}
+		}
+
+		close(c)
+		statsChan <- stats
+	}()
+
+	return c
+}
@@ -0,0 +1,334 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/colorstring"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Snapshot modes
+const (
+	SnapshotRecord = "record"
+	SnapshotVerify = "verify"
+)
+
+// Match rules which compare a response with a snapshot
+const (
+	MatchExact      = "exact"
+	MatchNumeric    = "numeric"
+	MatchAny        = "any"
+	MatchRegex      = "regex"
+	MatchJSONIgnore = "json-ignore"
+)
+
+// A MatchRule normalises the responses of a key before they are compared with
+// a snapshot, as given by the 'match' key attribute.
+type MatchRule struct {
+	Rule    string
+	Kind    string
+	Pattern *regexp.Regexp
+	Ignore  []string
+}
+
+// ParseMatchRule parses a match rule; one of 'exact', 'numeric', 'any',
+// 'regex:<pattern>' or 'json-ignore:<field>,<field>...'.
+func ParseMatchRule(s string) (*MatchRule, error) {
+	rule := &MatchRule{Rule: s, Kind: s}
+	arg := ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		rule.Kind, arg = s[:i], s[i+1:]
+	}
+
+	switch rule.Kind {
+	case MatchExact, MatchNumeric, MatchAny:
+		if arg != "" {
+			return nil, NewError(nil, "Unexpected argument in match rule: %s", s)
+		}
+
+	case MatchRegex:
+		pattern, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, NewError(err, "Invalid pattern in match rule: %s", s)
+		}
+		rule.Pattern = pattern
+
+	case MatchJSONIgnore:
+		rule.Ignore = strings.Split(arg, ",")
+
+	default:
+		return nil, NewError(nil, "Unknown match rule: %s", s)
+	}
+
+	return rule, nil
+}
+
+// Match returns true if a value matches the expected value under the rule.
+// Unsupported values match any other unsupported value, regardless of the
+// reason given by the agent.
+func (c *MatchRule) Match(expected *SnapshotEntry, result *Result) bool {
+	if result.Err != nil {
+		return false
+	}
+
+	if result.Unsupported() || expected.Unsupported {
+		return result.Unsupported() == expected.Unsupported
+	}
+
+	switch c.Kind {
+	case MatchNumeric:
+		_, err := strconv.ParseFloat(strings.TrimSpace(result.Value), 64)
+		return err == nil
+
+	case MatchAny:
+		return true
+
+	case MatchRegex:
+		return c.Pattern.MatchString(result.Value)
+
+	case MatchJSONIgnore:
+		var a, b interface{}
+		if json.Unmarshal([]byte(expected.Value), &a) != nil || json.Unmarshal([]byte(result.Value), &b) != nil {
+			return false
+		}
+		return reflect.DeepEqual(ignoreJSONFields(a, c.Ignore), ignoreJSONFields(b, c.Ignore))
+	}
+
+	return expected.Value == result.Value
+}
+
+// ignoreJSONFields removes the named fields from every object in a decoded
+// JSON document.
+func ignoreJSONFields(v interface{}, fields []string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, field := range fields {
+			delete(v, field)
+		}
+		for name, child := range v {
+			v[name] = ignoreJSONFields(child, fields)
+		}
+
+	case []interface{}:
+		for i, child := range v {
+			v[i] = ignoreJSONFields(child, fields)
+		}
+	}
+
+	return v
+}
+
+// A SnapshotEntry is the recorded response of a single key.
+type SnapshotEntry struct {
+	Value       string `json:"value"`
+	Unsupported bool   `json:"unsupported,omitempty"`
+	Match       string `json:"match,omitempty"`
+}
+
+// A SnapshotMismatch describes the responses of a key which did not match its
+// snapshot.
+type SnapshotMismatch struct {
+	Checks     int64
+	Mismatches int64
+	Expected   string
+	Last       string
+}
+
+// A Snapshot records the response of each key to a file, or verifies
+// responses against a previously recorded file.
+type Snapshot struct {
+	mu         sync.Mutex
+	Mode       string
+	Path       string
+	entries    map[string]*SnapshotEntry
+	rules      map[string]*MatchRule
+	mismatches map[string]*SnapshotMismatch
+}
+
+// NewSnapshot returns a Snapshot in the given mode. Snapshots to be verified
+// are loaded from the given path.
+func NewSnapshot(mode, path string) (*Snapshot, error) {
+	c := &Snapshot{
+		Mode:       mode,
+		Path:       path,
+		entries:    make(map[string]*SnapshotEntry, 0),
+		rules:      make(map[string]*MatchRule, 0),
+		mismatches: make(map[string]*SnapshotMismatch, 0),
+	}
+
+	switch mode {
+	case SnapshotRecord:
+
+	case SnapshotVerify:
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, NewError(err, "Failed to read snapshot")
+		}
+
+		if err := json.Unmarshal(b, &c.entries); err != nil {
+			return nil, NewError(err, "Failed to parse snapshot %s", path)
+		}
+
+		// keep the rules saved with each response for keys with no rule
+		for key, entry := range c.entries {
+			if entry.Match == "" {
+				continue
+			}
+
+			rule, err := ParseMatchRule(entry.Match)
+			if err != nil {
+				return nil, NewError(err, "Invalid match rule for %s in snapshot %s", key, path)
+			}
+			c.rules[key] = rule
+		}
+
+	default:
+		return nil, NewError(nil, "Unknown snapshot mode: %s", mode)
+	}
+
+	return c, nil
+}
+
+// Record records or verifies the result of a check of a key. When recording,
+// the last response of each key is kept; transport errors are not recorded.
+// When verifying, keys with no match rule use the rule saved with their
+// response.
+func (c *Snapshot) Record(key *ItemKey, result *Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rule := key.Match
+	if rule == nil && c.Mode == SnapshotVerify {
+		rule = c.rules[key.Key]
+	}
+	if rule == nil {
+		rule = &MatchRule{Rule: MatchExact, Kind: MatchExact}
+	}
+
+	if c.Mode == SnapshotRecord {
+		if result.Err == nil {
+			c.entries[key.Key] = &SnapshotEntry{
+				Value:       result.Value,
+				Unsupported: result.Unsupported(),
+				Match:       rule.Rule,
+			}
+		}
+		return
+	}
+
+	expected, ok := c.entries[key.Key]
+	if !ok {
+		return
+	}
+
+	mismatch, ok := c.mismatches[key.Key]
+	if !ok {
+		mismatch = &SnapshotMismatch{Expected: describeSnapshotEntry(expected)}
+		c.mismatches[key.Key] = mismatch
+	}
+
+	mismatch.Checks++
+	if !rule.Match(expected, result) {
+		mismatch.Mismatches++
+		mismatch.Last = describeValue(result)
+	}
+}
+
+func describeSnapshotEntry(entry *SnapshotEntry) string {
+	if entry.Unsupported {
+		return strconv.Quote(ErrorMessage)
+	}
+
+	return describeValue(&Result{Value: entry.Value})
+}
+
+// Save writes the recorded responses to the snapshot file.
+func (c *Snapshot) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return NewError(err, "Failed to encode snapshot")
+	}
+
+	if err := ioutil.WriteFile(c.Path, append(b, '\n'), 0644); err != nil {
+		return NewError(err, "Failed to write snapshot to %s", c.Path)
+	}
+
+	return nil
+}
+
+// Print prints the result of recording or verifying the snapshot and returns
+// the number of keys which did not match.
+func (c *Snapshot) Print(keyNames []string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Printf("\n=== Snapshot ===\n\n")
+	if c.Mode == SnapshotRecord {
+		fmt.Printf("Recorded %d of %d keys to %s\n", len(c.entries), len(keyNames), c.Path)
+		return 0
+	}
+
+	failed := 0
+	untested := make([]string, 0)
+	tested := make(map[string]bool, len(keyNames))
+	for _, name := range keyNames {
+		tested[name] = true
+		if _, ok := c.entries[name]; !ok {
+			untested = append(untested, name)
+			continue
+		}
+
+		mismatch, ok := c.mismatches[name]
+		if !ok || mismatch.Mismatches == 0 {
+			continue
+		}
+
+		failed++
+		fmt.Printf("%s: %d of %d responses did not match (expected %s, last %s)\n", colorize("red", name), mismatch.Mismatches, mismatch.Checks, mismatch.Expected, mismatch.Last)
+	}
+
+	missing := make([]string, 0)
+	for name := range c.entries {
+		if !tested[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+
+	if len(untested) > 0 {
+		fmt.Printf("Keys not in snapshot:\t%s\n", strings.Join(untested, ", "))
+	}
+	if len(missing) > 0 {
+		fmt.Printf("Keys only in snapshot:\t%s\n", strings.Join(missing, ", "))
+	}
+	if failed == 0 {
+		colorstring.Printf("[green]All responses matched[default] %s\n", c.Path)
+	}
+
+	return failed
+}
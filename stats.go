@@ -17,23 +17,214 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 )
 
+// latencyBucketCount is the number of buckets in a LatencyHistogram, not
+// including the overflow bucket.
+const latencyBucketCount = 50
+
+// latencyBuckets are the upper bounds of each LatencyHistogram bucket. Bounds
+// grow exponentially from 100µs to roughly 50s.
+var latencyBuckets = func() [latencyBucketCount]time.Duration {
+	var buckets [latencyBucketCount]time.Duration
+	bound := float64(100 * time.Microsecond)
+	for i := range buckets {
+		buckets[i] = time.Duration(bound)
+		bound *= 1.3
+	}
+
+	return buckets
+}()
+
+// A LatencyHistogram records the distribution of request latencies in fixed
+// buckets so that histograms from multiple goroutines may be added together
+// and percentiles estimated.
+type LatencyHistogram struct {
+	Count   int64
+	Sum     time.Duration
+	Min     time.Duration
+	Max     time.Duration
+	Buckets [latencyBucketCount + 1]int64
+}
+
+// Observe records a single latency.
+func (c *LatencyHistogram) Observe(d time.Duration) {
+	if c.Count == 0 || d < c.Min {
+		c.Min = d
+	}
+	if d > c.Max {
+		c.Max = d
+	}
+	c.Count++
+	c.Sum += d
+
+	i := 0
+	for i < latencyBucketCount && d > latencyBuckets[i] {
+		i++
+	}
+	c.Buckets[i]++
+}
+
+// Add adds all observations from the given histogram to this histogram.
+func (c *LatencyHistogram) Add(h LatencyHistogram) {
+	if h.Count == 0 {
+		return
+	}
+	if c.Count == 0 || h.Min < c.Min {
+		c.Min = h.Min
+	}
+	if h.Max > c.Max {
+		c.Max = h.Max
+	}
+	c.Count += h.Count
+	c.Sum += h.Sum
+
+	for i, n := range h.Buckets {
+		c.Buckets[i] += n
+	}
+}
+
+// sub removes all observations of an earlier snapshot of the same histogram.
+func (c *LatencyHistogram) sub(h LatencyHistogram) {
+	c.Count -= h.Count
+	c.Sum -= h.Sum
+	for i, n := range h.Buckets {
+		c.Buckets[i] -= n
+	}
+}
+
+// Mean returns the average of all observed latencies.
+func (c LatencyHistogram) Mean() time.Duration {
+	if c.Count == 0 {
+		return 0
+	}
+
+	return c.Sum / time.Duration(c.Count)
+}
+
+// Percentile returns an estimate of the given percentile (0 to 100) of all
+// observed latencies, interpolated within the bucket it falls in.
+func (c LatencyHistogram) Percentile(p float64) time.Duration {
+	if c.Count == 0 {
+		return 0
+	}
+
+	rank := p / 100 * float64(c.Count)
+	cumulative := int64(0)
+	for i, n := range c.Buckets {
+		if n == 0 || float64(cumulative+n) < rank {
+			cumulative += n
+			continue
+		}
+
+		lower, upper := c.Min, c.Max
+		if i > 0 && latencyBuckets[i-1] > lower {
+			lower = latencyBuckets[i-1]
+		}
+		if i < latencyBucketCount && latencyBuckets[i] < upper {
+			upper = latencyBuckets[i]
+		}
+
+		fraction := (rank - float64(cumulative)) / float64(n)
+		return lower + time.Duration(fraction*float64(upper-lower))
+	}
+
+	return c.Max
+}
+
+// formatLatency formats a latency in milliseconds for reports.
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+}
+
 type KeyStats struct {
 	Success      int64
 	NotSupported int64
 	Error        int64
+	Latency      LatencyHistogram
+
+	// Retry statistics
+	FirstTry int64
+	Retries  int64
+
+	// LastFailure describes the most recent failed check of the key.
+	LastFailure string
+
+	// Poller schedule statistics
+	Late          int64
+	Missed        int64
+	QueueDelay    time.Duration
+	MaxQueueDelay time.Duration
+}
+
+// Responses returns the number of requests for a key which received a
+// response from the agent, whether supported or not.
+func (c KeyStats) Responses() int64 {
+	return c.Success + c.NotSupported
+}
+
+// Polls returns the total number of requests made for a key.
+func (c KeyStats) Polls() int64 {
+	return c.Success + c.NotSupported + c.Error
+}
+
+// A Result is the outcome of a single check of an item key.
+type Result struct {
+	Value      string
+	Err        error
+	Start      time.Time
+	Latency    time.Duration
+	QueueDelay time.Duration
+	Late       bool
+	FirstTry   bool
+	Retries    int64
+}
+
+// Unsupported returns true if the agent responded with ZBX_NOTSUPPORTED.
+func (c *Result) Unsupported() bool {
+	return c.Err == nil && strings.HasPrefix(c.Value, ErrorMessage)
+}
+
+// Failure returns a description of why a check failed, including the reason
+// given by the agent for unsupported items, or an empty string if the check
+// succeeded.
+func (c *Result) Failure() string {
+	if c.Err != nil {
+		return c.Err.Error()
+	}
+
+	if c.Unsupported() {
+		reason := ErrorMessage
+		if i := strings.Index(c.Value, "\x00"); i >= 0 && i+1 < len(c.Value) {
+			reason += ": " + c.Value[i+1:]
+		}
+		return reason
+	}
+
+	return ""
 }
 
 // ThreadStats represents the sum statistics for all item keys gathered from a
 // Zabbix agent by a single goroutine.
+//
+// ThreadStats embeds a mutex which must be held while it is updated by the
+// owning goroutine or read by any other goroutine.
 type ThreadStats struct {
+	sync.Mutex
 	Duration          time.Duration
 	Iterations        int64
 	TotalValues       int64
 	UnsupportedValues int64
 	ErrorCount        int64
+	LateCount         int64
+	MissedCount       int64
+	FirstTryCount     int64
+	RetryCount        int64
+	Latency           LatencyHistogram
 	KeyStats          map[string]KeyStats
 }
 
@@ -43,6 +234,94 @@ func NewThreadStats() *ThreadStats {
 	}
 }
 
+// Record adds the result of a single check of the given key to the stats.
+func (c *ThreadStats) Record(key string, result *Result) {
+	c.Lock()
+	defer c.Unlock()
+
+	keyStats := c.KeyStats[key]
+	keyStats.Latency.Observe(result.Latency)
+	c.Latency.Observe(result.Latency)
+
+	keyStats.QueueDelay += result.QueueDelay
+	if result.QueueDelay > keyStats.MaxQueueDelay {
+		keyStats.MaxQueueDelay = result.QueueDelay
+	}
+	if result.Late {
+		c.LateCount++
+		keyStats.Late++
+	}
+
+	if result.FirstTry {
+		c.FirstTryCount++
+		keyStats.FirstTry++
+	}
+	c.RetryCount += result.Retries
+	keyStats.Retries += result.Retries
+
+	if failure := result.Failure(); failure != "" {
+		keyStats.LastFailure = failure
+	}
+
+	if result.Err != nil {
+		c.ErrorCount++
+		keyStats.Error++
+	} else {
+		c.TotalValues++
+		if result.Unsupported() {
+			c.UnsupportedValues++
+			keyStats.NotSupported++
+		} else {
+			keyStats.Success++
+		}
+	}
+
+	c.KeyStats[key] = keyStats
+}
+
+// Snapshot returns a copy of the stats, taken while holding the lock.
+func (c *ThreadStats) Snapshot() *ThreadStats {
+	c.Lock()
+	defer c.Unlock()
+
+	stats := NewThreadStats()
+	stats.Add(c)
+	return stats
+}
+
+// Delta returns the difference between these stats and an earlier snapshot of
+// the same stats. The minimum and maximum latencies of the delta are those of
+// the later stats.
+func (c *ThreadStats) Delta(prev *ThreadStats) *ThreadStats {
+	delta := NewThreadStats()
+	delta.Add(c)
+	delta.Iterations -= prev.Iterations
+	delta.TotalValues -= prev.TotalValues
+	delta.UnsupportedValues -= prev.UnsupportedValues
+	delta.ErrorCount -= prev.ErrorCount
+	delta.LateCount -= prev.LateCount
+	delta.MissedCount -= prev.MissedCount
+	delta.FirstTryCount -= prev.FirstTryCount
+	delta.RetryCount -= prev.RetryCount
+	delta.Latency.sub(prev.Latency)
+
+	for key, keyStats := range delta.KeyStats {
+		prevStats := prev.KeyStats[key]
+		keyStats.Success -= prevStats.Success
+		keyStats.NotSupported -= prevStats.NotSupported
+		keyStats.Error -= prevStats.Error
+		keyStats.Late -= prevStats.Late
+		keyStats.Missed -= prevStats.Missed
+		keyStats.QueueDelay -= prevStats.QueueDelay
+		keyStats.FirstTry -= prevStats.FirstTry
+		keyStats.Retries -= prevStats.Retries
+		keyStats.Latency.sub(prevStats.Latency)
+		delta.KeyStats[key] = keyStats
+	}
+
+	return delta
+}
+
 // Add adds all stats from the specified ThreadStats struct to this ThreadStats
 // struct
 func (c *ThreadStats) Add(stats *ThreadStats) {
@@ -50,6 +329,11 @@ func (c *ThreadStats) Add(stats *ThreadStats) {
 	c.TotalValues += stats.TotalValues
 	c.UnsupportedValues += stats.UnsupportedValues
 	c.ErrorCount += stats.ErrorCount
+	c.LateCount += stats.LateCount
+	c.MissedCount += stats.MissedCount
+	c.FirstTryCount += stats.FirstTryCount
+	c.RetryCount += stats.RetryCount
+	c.Latency.Add(stats.Latency)
 
 	// add stats for each key
 	for key, keyStats := range stats.KeyStats {
@@ -58,6 +342,18 @@ func (c *ThreadStats) Add(stats *ThreadStats) {
 		tKeyStats.Success += keyStats.Success
 		tKeyStats.NotSupported += keyStats.NotSupported
 		tKeyStats.Error += keyStats.Error
+		tKeyStats.Latency.Add(keyStats.Latency)
+		tKeyStats.FirstTry += keyStats.FirstTry
+		tKeyStats.Retries += keyStats.Retries
+		if keyStats.LastFailure != "" {
+			tKeyStats.LastFailure = keyStats.LastFailure
+		}
+		tKeyStats.Late += keyStats.Late
+		tKeyStats.Missed += keyStats.Missed
+		tKeyStats.QueueDelay += keyStats.QueueDelay
+		if keyStats.MaxQueueDelay > tKeyStats.MaxQueueDelay {
+			tKeyStats.MaxQueueDelay = keyStats.MaxQueueDelay
+		}
 
 		c.KeyStats[key] = tKeyStats
 	}
@@ -0,0 +1,343 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Time series formats
+const (
+	FormatCSV        = "csv"
+	FormatJSONLines  = "jsonl"
+	TotalsSeriesName = "*"
+)
+
+// A Sample holds the change in stats of a test over a single interval.
+type Sample struct {
+	Time     time.Time
+	Elapsed  time.Duration
+	Interval time.Duration
+	Stats    *ThreadStats
+}
+
+// A SampleWriter receives every sample taken by a Sampler.
+type SampleWriter interface {
+	WriteSample(sample *Sample) error
+	Close() error
+}
+
+// A Sampler takes a sample of the stats of all goroutines registered with a
+// Monitor at a fixed interval and passes it to each of its writers.
+type Sampler struct {
+	monitor  *Monitor
+	interval time.Duration
+	writers  []SampleWriter
+	prev     *ThreadStats
+	last     time.Duration
+	quit     chan bool
+	done     chan bool
+}
+
+// NewSampler returns a Sampler which samples the given monitor every interval.
+func NewSampler(m *Monitor, interval time.Duration) *Sampler {
+	return &Sampler{
+		monitor:  m,
+		interval: interval,
+		writers:  make([]SampleWriter, 0),
+		prev:     NewThreadStats(),
+		quit:     make(chan bool),
+		done:     make(chan bool),
+	}
+}
+
+// AddWriter adds a writer which will receive every sample. Writers must be
+// added before the sampler is started.
+func (c *Sampler) AddWriter(w SampleWriter) {
+	c.writers = append(c.writers, w)
+}
+
+// Start starts a goroutine which takes a sample every interval until Stop is
+// called. Nothing is sampled if the sampler has no writers.
+func (c *Sampler) Start() {
+	if len(c.writers) == 0 {
+		close(c.done)
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		defer close(c.done)
+
+		for {
+			select {
+			case <-ticker.C:
+				c.sample()
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop takes a final sample of any remaining partial interval and closes all
+// writers.
+func (c *Sampler) Stop() {
+	close(c.quit)
+	<-c.done
+
+	if len(c.writers) > 0 && c.monitor.Elapsed() > c.last {
+		c.sample()
+	}
+
+	for _, w := range c.writers {
+		if err := w.Close(); err != nil {
+			PrintWarning(NewError(err, "Failed to close time series output"))
+		}
+	}
+}
+
+func (c *Sampler) sample() {
+	elapsed := c.monitor.Elapsed()
+	stats := c.monitor.Snapshot()
+	sample := &Sample{
+		Time:     time.Now(),
+		Elapsed:  elapsed,
+		Interval: elapsed - c.last,
+		Stats:    stats.Delta(c.prev),
+	}
+	c.prev, c.last = stats, elapsed
+
+	for _, w := range c.writers {
+		if err := w.WriteSample(sample); err != nil {
+			PrintWarning(NewError(err, "Failed to write time series sample"))
+		}
+	}
+}
+
+// A SeriesPoint is the stats of all keys or a single key in a Sample, as
+// written to time series output.
+type SeriesPoint struct {
+	Time        time.Time `json:"time"`
+	Elapsed     float64   `json:"elapsed"`
+	Key         string    `json:"key"`
+	Requests    int64     `json:"requests"`
+	Success     int64     `json:"success"`
+	Unsupported int64     `json:"unsupported"`
+	Errors      int64     `json:"errors"`
+	Rate        float64   `json:"rate"`
+	MeanMs      float64   `json:"mean_ms"`
+	P50Ms       float64   `json:"p50_ms"`
+	P95Ms       float64   `json:"p95_ms"`
+	P99Ms       float64   `json:"p99_ms"`
+}
+
+// Points returns a point for the totals of the sample, named
+// TotalsSeriesName, followed by a point for each key sorted by name.
+func (c *Sample) Points() []*SeriesPoint {
+	newPoint := func(key string, keyStats KeyStats) *SeriesPoint {
+		return &SeriesPoint{
+			Time:        c.Time,
+			Elapsed:     c.Elapsed.Seconds(),
+			Key:         key,
+			Requests:    keyStats.Polls(),
+			Success:     keyStats.Success,
+			Unsupported: keyStats.NotSupported,
+			Errors:      keyStats.Error,
+			Rate:        float64(keyStats.Polls()) / c.Interval.Seconds(),
+			MeanMs:      milliseconds(keyStats.Latency.Mean()),
+			P50Ms:       milliseconds(keyStats.Latency.Percentile(50)),
+			P95Ms:       milliseconds(keyStats.Latency.Percentile(95)),
+			P99Ms:       milliseconds(keyStats.Latency.Percentile(99)),
+		}
+	}
+
+	totals := KeyStats{
+		Success:      c.Stats.TotalValues - c.Stats.UnsupportedValues,
+		NotSupported: c.Stats.UnsupportedValues,
+		Error:        c.Stats.ErrorCount,
+		Latency:      c.Stats.Latency,
+	}
+	points := []*SeriesPoint{newPoint(TotalsSeriesName, totals)}
+
+	keys := make([]string, 0, len(c.Stats.KeyStats))
+	for key := range c.Stats.KeyStats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		points = append(points, newPoint(key, c.Stats.KeyStats[key]))
+	}
+
+	return points
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// SampleHistory keeps the totals of every sample in memory so they may be
+// included in reports at the end of a run.
+type SampleHistory struct {
+	mu     sync.Mutex
+	points []*SeriesPoint
+}
+
+// WriteSample appends the totals of a sample to the history.
+func (c *SampleHistory) WriteSample(sample *Sample) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.points = append(c.points, sample.Points()[0])
+	return nil
+}
+
+// Close does nothing; the history remains available.
+func (c *SampleHistory) Close() error {
+	return nil
+}
+
+// Points returns the totals of every sample in the history.
+func (c *SampleHistory) Points() []*SeriesPoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.points
+}
+
+// TimeSeriesFile writes samples to a file in CSV or JSON Lines format, with
+// one row for the totals and one row for each key per sample.
+type TimeSeriesFile struct {
+	file   *os.File
+	w      *bufio.Writer
+	csv    *csv.Writer
+	format string
+}
+
+// TimeSeriesFormat returns the format of a time series file, guessed from
+// its extension if not given.
+func TimeSeriesFormat(path, format string) string {
+	if format != "" {
+		return format
+	}
+
+	switch filepath.Ext(path) {
+	case ".jsonl", ".json", ".ndjson":
+		return FormatJSONLines
+	}
+
+	return FormatCSV
+}
+
+// NewTimeSeriesFile creates a time series file at the given path.
+func NewTimeSeriesFile(path, format string) (*TimeSeriesFile, error) {
+	if format != FormatCSV && format != FormatJSONLines {
+		return nil, NewError(nil, "Unknown time series format: %s", format)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &TimeSeriesFile{
+		file:   file,
+		w:      bufio.NewWriter(file),
+		format: format,
+	}
+
+	if format == FormatCSV {
+		c.csv = csv.NewWriter(c.w)
+		c.csv.Write([]string{"time", "elapsed", "key", "requests", "success", "unsupported", "errors", "rate", "mean_ms", "p50_ms", "p95_ms", "p99_ms"})
+	}
+
+	return c, nil
+}
+
+// WriteSample writes all points of a sample.
+func (c *TimeSeriesFile) WriteSample(sample *Sample) error {
+	for _, point := range sample.Points() {
+		var err error
+		if c.csv != nil {
+			err = c.csv.Write([]string{
+				point.Time.Format(time.RFC3339),
+				formatFloat(point.Elapsed),
+				point.Key,
+				strconv.FormatInt(point.Requests, 10),
+				strconv.FormatInt(point.Success, 10),
+				strconv.FormatInt(point.Unsupported, 10),
+				strconv.FormatInt(point.Errors, 10),
+				formatFloat(point.Rate),
+				formatFloat(point.MeanMs),
+				formatFloat(point.P50Ms),
+				formatFloat(point.P95Ms),
+				formatFloat(point.P99Ms),
+			})
+		} else {
+			err = writeJSONLine(c.w, point)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// flush each sample so the file may be followed during a run
+	if c.csv != nil {
+		c.csv.Flush()
+		if err := c.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	return c.w.Flush()
+}
+
+// Close flushes and closes the file.
+func (c *TimeSeriesFile) Close() error {
+	if err := c.w.Flush(); err != nil {
+		c.file.Close()
+		return err
+	}
+
+	return c.file.Close()
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
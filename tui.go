@@ -0,0 +1,459 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mitchellh/colorstring"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errorFeed collects failed checks for the dashboard, if enabled.
+var errorFeed *ErrorFeed
+
+// An ErrorFeedEntry is a single failed check in an ErrorFeed.
+type ErrorFeedEntry struct {
+	Time    time.Time
+	Key     string
+	Message string
+}
+
+// An ErrorFeed keeps the most recent failed checks. It is safe for use by
+// multiple goroutines.
+type ErrorFeed struct {
+	mu      sync.Mutex
+	size    int
+	entries []ErrorFeedEntry
+}
+
+// NewErrorFeed returns an ErrorFeed which keeps the given number of entries.
+func NewErrorFeed(size int) *ErrorFeed {
+	return &ErrorFeed{
+		size:    size,
+		entries: make([]ErrorFeedEntry, 0, size),
+	}
+}
+
+// Add appends a failed check to the feed, discarding the oldest entry if the
+// feed is full.
+func (c *ErrorFeed) Add(key, message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) == c.size {
+		c.entries = c.entries[1:]
+	}
+	c.entries = append(c.entries, ErrorFeedEntry{
+		Time:    time.Now(),
+		Key:     key,
+		Message: message,
+	})
+}
+
+// Latest returns up to n of the most recent entries, newest first.
+func (c *ErrorFeed) Latest(n int) []ErrorFeedEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := []ErrorFeedEntry{}
+	for i := len(c.entries) - 1; i >= 0 && len(entries) < n; i-- {
+		entries = append(entries, c.entries[i])
+	}
+
+	return entries
+}
+
+// Dashboard sort orders
+const (
+	SortByLatency = iota
+	SortByErrors
+	SortByName
+)
+
+var sortNames = []string{"p95 latency", "errors", "name"}
+
+// sparkRunes are the bars used to draw sparklines, from lowest to highest.
+var sparkRunes = []rune("▁▂▃▄▅▆▇█")
+
+// A Dashboard is a full screen terminal user interface which shows live
+// results while a test is in progress and accepts keyboard commands to pause
+// the test, change the number of threads and inspect individual keys.
+type Dashboard struct {
+	keys      ItemKeys
+	pool      *ConsumerPool
+	monitor   *Monitor
+	timeLimit time.Duration
+	ttyState  string
+	done      chan bool
+
+	mu       sync.Mutex
+	sortBy   int
+	selected string
+	detail   bool
+	rows     int
+	cols     int
+	nvps     []float64
+	last     *ThreadStats
+	lastTime time.Duration
+}
+
+// IsTerminal returns true if the given file is a terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// stty runs the stty command on the terminal attached to stdin.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// NewDashboard switches the terminal to an alternate screen with unbuffered
+// input and returns a Dashboard ready to be started. Close must be called to
+// restore the terminal.
+func NewDashboard(keys ItemKeys, pool *ConsumerPool, m *Monitor, timeLimit time.Duration) (*Dashboard, error) {
+	if !IsTerminal(os.Stdin) || !IsTerminal(os.Stdout) {
+		return nil, NewError(nil, "Dashboard requires a terminal")
+	}
+
+	state, err := stty("-g")
+	if err != nil {
+		return nil, NewError(err, "Failed to read terminal settings")
+	}
+
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return nil, NewError(err, "Failed to configure terminal")
+	}
+
+	c := &Dashboard{
+		keys:      keys,
+		pool:      pool,
+		monitor:   m,
+		timeLimit: timeLimit,
+		ttyState:  state,
+		done:      make(chan bool),
+		nvps:      make([]float64, 0),
+		last:      NewThreadStats(),
+		rows:      24,
+		cols:      80,
+	}
+
+	// alternate screen, hidden cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	return c, nil
+}
+
+// Start starts the goroutines which read keyboard input and redraw the
+// dashboard until the test is stopped.
+func (c *Dashboard) Start() {
+	go c.readInput()
+	go func() {
+		for i := 0; !stop; i++ {
+			// sample stats every second and redraw four times a second
+			if i%4 == 0 {
+				c.sample()
+			}
+			c.draw()
+			time.Sleep(250 * time.Millisecond)
+		}
+		close(c.done)
+	}()
+}
+
+// Close waits for the dashboard to stop drawing and restores the terminal.
+func (c *Dashboard) Close() {
+	<-c.done
+	fmt.Print("\x1b[?25h\x1b[?1049l")
+	stty(c.ttyState)
+}
+
+// sample updates the terminal size and the throughput history.
+func (c *Dashboard) sample() {
+	size, _ := stty("size")
+	elapsed := c.monitor.Elapsed()
+	stats := c.monitor.Snapshot()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var rows, cols int
+	if n, _ := fmt.Sscanf(size, "%d %d", &rows, &cols); n == 2 && rows > 0 && cols > 0 {
+		c.rows, c.cols = rows, cols
+	}
+
+	if interval := elapsed - c.lastTime; interval > 0 {
+		delta := stats.Delta(c.last)
+		c.nvps = append(c.nvps, float64(delta.TotalValues)/interval.Seconds())
+		if len(c.nvps) > c.cols {
+			c.nvps = c.nvps[len(c.nvps)-c.cols:]
+		}
+	}
+	c.last, c.lastTime = stats, elapsed
+}
+
+// readInput handles keyboard commands until the test is stopped.
+func (c *Dashboard) readInput() {
+	buf := make([]byte, 8)
+	for !stop {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		switch input := string(buf[:n]); input {
+		case "q":
+			stop = true
+
+		case "p":
+			togglePaused()
+
+		case "+", "=":
+			c.pool.Resize(c.pool.Size() + 1)
+
+		case "-":
+			if size := c.pool.Size(); size > 1 {
+				c.pool.Resize(size - 1)
+			}
+
+		case "s":
+			c.sortBy = (c.sortBy + 1) % len(sortNames)
+
+		case "k", "\x1b[A":
+			c.moveSelection(-1)
+
+		case "j", "\x1b[B":
+			c.moveSelection(1)
+
+		case "\r", "\n":
+			c.detail = !c.detail
+
+		case "\x1b", "\x7f":
+			c.detail = false
+		}
+		c.mu.Unlock()
+
+		c.draw()
+	}
+}
+
+// moveSelection selects the key n rows below the selected key in the current
+// sort order.
+func (c *Dashboard) moveSelection(n int) {
+	names := c.sortedKeys(c.monitor.Snapshot())
+	i := c.selectedIndex(names) + n
+	if i >= 0 && i < len(names) {
+		c.selected = names[i]
+	}
+}
+
+// selectedIndex returns the row of the selected key, selecting the first key
+// if none is selected.
+func (c *Dashboard) selectedIndex(names []string) int {
+	for i, name := range names {
+		if name == c.selected {
+			return i
+		}
+	}
+
+	if len(names) > 0 {
+		c.selected = names[0]
+	}
+
+	return 0
+}
+
+// sortedKeys returns the names of all keys in the current sort order.
+func (c *Dashboard) sortedKeys(stats *ThreadStats) []string {
+	names := c.keys.SortedKeyNames()
+	sort.Stable(keySorter{names, stats, c.sortBy})
+	return names
+}
+
+type keySorter struct {
+	names  []string
+	stats  *ThreadStats
+	sortBy int
+}
+
+func (c keySorter) Len() int      { return len(c.names) }
+func (c keySorter) Swap(i, j int) { c.names[i], c.names[j] = c.names[j], c.names[i] }
+func (c keySorter) Less(i, j int) bool {
+	a, b := c.stats.KeyStats[c.names[i]], c.stats.KeyStats[c.names[j]]
+	switch c.sortBy {
+	case SortByLatency:
+		return a.Latency.Percentile(95) > b.Latency.Percentile(95)
+	case SortByErrors:
+		return a.Error+a.NotSupported > b.Error+b.NotSupported
+	}
+
+	return false
+}
+
+// draw renders the dashboard to the terminal.
+func (c *Dashboard) draw() {
+	elapsed := c.monitor.Elapsed()
+	stats := c.monitor.Snapshot()
+	threads := c.pool.Size()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	line := func(format string, a ...interface{}) {
+		s := fmt.Sprintf(format, a...)
+		if r := []rune(s); len(r) > c.cols {
+			s = string(r[:c.cols])
+		}
+		buf.WriteString(s + "\x1b[K\r\n")
+	}
+
+	// header
+	state := colorstring.Color("[green]RUNNING")
+	if isPaused() {
+		state = colorstring.Color("[yellow]PAUSED")
+	}
+	remaining := ""
+	if c.timeLimit > 0 {
+		remaining = fmt.Sprintf(", %s remaining", (c.timeLimit-elapsed)/time.Second*time.Second)
+	}
+	buf.WriteString("\x1b[H")
+	line("%s v%s - %s - %d threads - %s%s - %s elapsed%s", APP, APP_VERSION, host, threads, state, colorstring.Color("[default]"), elapsed/time.Second*time.Second, remaining)
+
+	nvps := 0.0
+	if len(c.nvps) > 0 {
+		nvps = c.nvps[len(c.nvps)-1]
+	}
+	line("NVPS %.1f  values %d  unsupported %d  errors %d  p99 %s", nvps, stats.TotalValues, stats.UnsupportedValues, stats.ErrorCount, formatLatency(stats.Latency.Percentile(99)))
+	line("%s", sparkline(c.nvps, c.cols))
+	line("")
+
+	// body
+	feedLines := 5
+	bodyRows := c.rows - 4 - feedLines - 3
+	if c.detail {
+		c.drawDetail(line, stats)
+	} else {
+		c.drawTable(line, stats, bodyRows)
+	}
+
+	// error feed
+	line("")
+	line("%s", colorstring.Color("[bold]Latest errors[reset]"))
+	for _, entry := range errorFeed.Latest(feedLines) {
+		line("%s %s: %s", entry.Time.Format("15:04:05"), entry.Key, strings.Replace(entry.Message, "\n", " ", -1))
+	}
+
+	// help
+	buf.WriteString("\x1b[J")
+	buf.WriteString(fmt.Sprintf("\x1b[%d;1H", c.rows))
+	buf.WriteString("\x1b[7m up/down select  enter details  s sort  p pause  +/- threads  q quit \x1b[0m")
+
+	os.Stdout.Write(buf.Bytes())
+}
+
+// drawTable renders the table of keys with the selected key highlighted.
+func (c *Dashboard) drawTable(line func(string, ...interface{}), stats *ThreadStats, rows int) {
+	names := c.sortedKeys(stats)
+	width := c.keys.LongestKeyName()
+	if max := c.cols - 50; width > max && max > 10 {
+		width = max
+	}
+
+	line("%s", colorstring.Color(fmt.Sprintf("[bold]  %-*s %8s %8s %8s %10s %10s %10s[reset]   sorted by %s", width, "KEY", "OK", "UNSUP", "ERR", "p50", "p95", "p99", sortNames[c.sortBy])))
+
+	selected := c.selectedIndex(names)
+	offset := 0
+	if selected >= rows && rows > 0 {
+		offset = selected - rows + 1
+	}
+
+	for i := offset; i < len(names) && i < offset+rows; i++ {
+		keyStats := stats.KeyStats[names[i]]
+		name := names[i]
+		if len(name) > width {
+			name = name[:width-1] + "~"
+		}
+
+		row := fmt.Sprintf("%-*s %8d %8d %8d %10s %10s %10s", width, name, keyStats.Success, keyStats.NotSupported, keyStats.Error, formatLatency(keyStats.Latency.Percentile(50)), formatLatency(keyStats.Latency.Percentile(95)), formatLatency(keyStats.Latency.Percentile(99)))
+		switch {
+		case i == selected:
+			line("> \x1b[7m%s\x1b[0m", row)
+		case keyStats.Error > 0:
+			line("  \x1b[31m%s\x1b[0m", row)
+		case keyStats.NotSupported > 0:
+			line("  \x1b[33m%s\x1b[0m", row)
+		default:
+			line("  %s", row)
+		}
+	}
+}
+
+// drawDetail renders all stats of the selected key.
+func (c *Dashboard) drawDetail(line func(string, ...interface{}), stats *ThreadStats) {
+	c.selectedIndex(c.keys.SortedKeyNames())
+	name := c.selected
+	key := c.keys.Get(name)
+	keyStats := stats.KeyStats[name]
+
+	line("\x1b[1m%s\x1b[0m", name)
+	line("  defined in:     %s", key.OriginString())
+	line("  timeout:        %s", key.TimeoutOr(timeout))
+	line("  success:        %d", keyStats.Success)
+	line("  unsupported:    %d", keyStats.NotSupported)
+	line("  errors:         %d", keyStats.Error)
+	line("  retries:        %d", keyStats.Retries)
+	line("  late / missed:  %d / %d", keyStats.Late, keyStats.Missed)
+	line("  latency:        min %s  mean %s  max %s", formatLatency(keyStats.Latency.Min), formatLatency(keyStats.Latency.Mean()), formatLatency(keyStats.Latency.Max))
+	line("  percentiles:    p50 %s  p95 %s  p99 %s", formatLatency(keyStats.Latency.Percentile(50)), formatLatency(keyStats.Latency.Percentile(95)), formatLatency(keyStats.Latency.Percentile(99)))
+	line("  last failure:   %s", strings.Replace(keyStats.LastFailure, "\n", " ", -1))
+}
+
+// sparkline draws the last width values as a line of bars scaled to the
+// largest value.
+func sparkline(values []float64, width int) string {
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+
+	max := 0.0
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+
+	runes := make([]rune, len(values))
+	for i, v := range values {
+		n := 0
+		if max > 0 {
+			n = int(v / max * float64(len(sparkRunes)-1))
+		}
+		runes[i] = sparkRunes[n]
+	}
+
+	return string(runes)
+}
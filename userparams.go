@@ -0,0 +1,78 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// UserParamsCommand implements the 'userparams' command which prints a key
+// file containing every UserParameter found in a Zabbix agent configuration
+// file.
+func UserParamsCommand(args []string) {
+	var outPath string
+
+	flags := flag.NewFlagSet("userparams", flag.ExitOnError)
+	flags.StringVar(&outPath, "o", "", "write key file to path instead of stdout")
+	flags.BoolVar(&debug, "debug", false, "print program debug messages")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s userparams [options] <zabbix_agentd.conf>\n", APP)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	config, err := LoadAgentConfig(flags.Arg(0))
+	PanicOn(err, "Failed to load agent config")
+
+	var w io.Writer = os.Stdout
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		PanicOn(err, "Failed to create key file")
+		defer f.Close()
+		w = f
+	}
+
+	err = WriteUserParamKeys(w, config)
+	PanicOn(err, "Failed to write key file")
+}
+
+// WriteUserParamKeys writes a key file containing every UserParameter in the
+// given agent configuration. Parameters of flexible UserParameters are written
+// as environment variable placeholders which may be set at runtime or edited
+// in the key file.
+func WriteUserParamKeys(w io.Writer, config *AgentConfig) error {
+	if _, err := fmt.Fprintf(w, "# UserParameters from %s\n", config.Path); err != nil {
+		return err
+	}
+
+	for _, param := range config.UserParameters {
+		_, err := fmt.Fprintf(w, "\n# %s: %s\n%s\n", param.Origin, param.Command, param.PlaceholderKey())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+/*
+ * Zabbix Agent Bench (C) 2014  Ryan Armstrong <ryan@cavaliercoder.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"github.com/mitchellh/colorstring"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of value returned by a key, as given by the 'value' key attribute
+const (
+	ValueAny      = "any"
+	ValueConstant = "const"
+	ValueCounter  = "counter"
+)
+
+// constantKeys are keys which are expected to return the same value for the
+// life of an agent process unless given another value kind.
+var constantKeys = []string{
+	"agent.hostname",
+	"agent.ping",
+	"agent.version",
+	"system.boottime",
+	"system.sw.arch",
+	"system.uname",
+}
+
+// counterKeys are the names of keys which are expected to return an
+// increasing value unless given another value kind.
+var counterKeys = []string{
+	"net.if.in",
+	"net.if.out",
+	"net.if.total",
+	"system.cpu.intr",
+	"system.cpu.switches",
+	"system.uptime",
+}
+
+// ValueKind returns the kind of value expected from a key; either the kind
+// given by the key's 'value' attribute or a kind known for the key name.
+func (c *ItemKey) ValueKind() string {
+	if c.Value != "" {
+		return c.Value
+	}
+
+	name := c.Key
+	if i := strings.Index(name, "["); i >= 0 {
+		name = name[:i]
+	}
+
+	for _, key := range constantKeys {
+		if name == key {
+			return ValueConstant
+		}
+	}
+
+	for _, key := range counterKeys {
+		if name == key {
+			return ValueCounter
+		}
+	}
+
+	return ValueAny
+}
+
+// ValueTrack holds the value history of a key used to detect inconsistent
+// values.
+type ValueTrack struct {
+	Kind   string
+	Checks int64
+
+	// Flips is the number of times the key changed between supported and
+	// unsupported.
+	Flips int64
+
+	// Changes is the number of times a constant key changed value.
+	Changes int64
+
+	// Decreases is the number of times a counter decreased.
+	Decreases int64
+
+	// Empty and NonEmpty count the empty and non-empty values returned.
+	Empty    int64
+	NonEmpty int64
+
+	// LastAnomaly describes the most recent inconsistent pair of values.
+	LastAnomaly string
+
+	// last is the result of the most recently completed check, with the time
+	// the check completed.
+	last    *Result
+	lastEnd time.Time
+}
+
+// Anomalies returns the number of inconsistent values seen. Empty values are
+// only inconsistent if the key also returned non-empty values.
+func (c *ValueTrack) Anomalies() int64 {
+	n := c.Flips + c.Changes + c.Decreases
+	if c.NonEmpty > 0 {
+		n += c.Empty
+	}
+
+	return n
+}
+
+// A ValueTracker records the values returned for each key across iterations
+// and counts inconsistencies such as keys which flip between supported and
+// unsupported, constant keys which change and counters which decrease.
+//
+// Since checks of the same key may run concurrently, each result is only
+// compared with the latest result of a check which completed before it was
+// started, so that responses which overlapped are never compared.
+type ValueTracker struct {
+	mu   sync.Mutex
+	keys map[string]*ValueTrack
+}
+
+// NewValueTracker returns an empty ValueTracker.
+func NewValueTracker() *ValueTracker {
+	return &ValueTracker{
+		keys: make(map[string]*ValueTrack, 0),
+	}
+}
+
+// Record adds the result of a check of the given key.
+func (c *ValueTracker) Record(key *ItemKey, result *Result) {
+	if result.Err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	track, ok := c.keys[key.Key]
+	if !ok {
+		track = &ValueTrack{Kind: key.ValueKind()}
+		c.keys[key.Key] = track
+	}
+	track.Checks++
+
+	unsupported := result.Unsupported()
+	if !unsupported {
+		if strings.TrimSpace(result.Value) == "" {
+			track.Empty++
+		} else {
+			track.NonEmpty++
+		}
+	}
+
+	end := result.Start.Add(result.Latency)
+	if track.last != nil && !result.Start.Before(track.lastEnd) {
+		prev := track.last
+		anomaly := false
+		switch {
+		case prev.Unsupported() != unsupported:
+			track.Flips++
+			anomaly = true
+
+		case unsupported:
+			// the reasons given for unsupported values are not compared
+
+		case track.Kind == ValueConstant && prev.Value != result.Value:
+			track.Changes++
+			anomaly = true
+
+		case track.Kind == ValueCounter && counterDecreased(prev.Value, result.Value):
+			track.Decreases++
+			anomaly = true
+		}
+
+		if anomaly {
+			track.LastAnomaly = fmt.Sprintf("%s then %s", describeValue(prev), describeValue(result))
+		}
+	}
+
+	if track.last == nil || end.After(track.lastEnd) {
+		track.last, track.lastEnd = result, end
+	}
+}
+
+// counterDecreased returns true if both values are numbers and b is less than
+// a.
+func counterDecreased(a, b string) bool {
+	x, err := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	if err != nil {
+		return false
+	}
+
+	y, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	if err != nil {
+		return false
+	}
+
+	return y < x
+}
+
+// Get returns a copy of the value history of a key.
+func (c *ValueTracker) Get(key string) ValueTrack {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if track, ok := c.keys[key]; ok {
+		return *track
+	}
+
+	return ValueTrack{}
+}
+
+// Print prints every key with inconsistent values and returns the number of
+// keys printed.
+func (c *ValueTracker) Print(keyNames []string) int {
+	n := 0
+	for _, name := range keyNames {
+		track := c.Get(name)
+		if track.Anomalies() == 0 {
+			continue
+		}
+
+		if n == 0 {
+			colorstring.Printf("\n[yellow]=== Value anomalies ===[default]\n\n")
+		}
+		n++
+
+		problems := []string{}
+		if track.Flips > 0 {
+			problems = append(problems, fmt.Sprintf("%d supported/unsupported flips", track.Flips))
+		}
+		if track.Changes > 0 {
+			problems = append(problems, fmt.Sprintf("%d changes of a constant value", track.Changes))
+		}
+		if track.Decreases > 0 {
+			problems = append(problems, fmt.Sprintf("%d counter decreases", track.Decreases))
+		}
+		if track.NonEmpty > 0 && track.Empty > 0 {
+			problems = append(problems, fmt.Sprintf("%d empty values", track.Empty))
+		}
+
+		fmt.Printf("%s: %s in %d checks\n", name, strings.Join(problems, ", "), track.Checks)
+		if track.LastAnomaly != "" {
+			fmt.Printf("    last: %s\n", track.LastAnomaly)
+		}
+	}
+
+	return n
+}